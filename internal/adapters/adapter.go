@@ -2,34 +2,146 @@ package adapters
 
 import (
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"realtimer/internal/config"
+	"realtimer/internal/pubsub"
 	"strings"
 )
 
 var db *sql.DB
 
-func New(cfg config.DBConfig) error {
+func New(cfg config.DBConfig, pubsubManager *pubsub.SubscriptionManager) error {
 	if cfg.Database.Type == "mysql" {
 		_, err := newMySQL(cfg)
 
 		if err != nil {
 			return err
 		}
-
-		return nil
 	} else if cfg.Database.Type == "postgres" {
-		_, err := newPostgresAdapter(cfg)
+		_, err := newPostgresAdapter(cfg, pubsubManager)
+
+		if err != nil {
+			return err
+		}
+	} else if cfg.Database.Type == "sqlite" {
+		_, err := newSQLiteAdapter(cfg, pubsubManager)
+
+		if err != nil {
+			return err
+		}
+	} else if cfg.Database.Type == "mongodb" {
+		_, err := newMongoAdapter(cfg, pubsubManager)
 
 		if err != nil {
 			return err
 		}
+	} else if cfg.Database.Type == "debezium" {
+		_, err := newDebeziumAdapter(cfg, pubsubManager)
 
-		return nil
+		if err != nil {
+			return err
+		}
 	} else {
 		return errors.New("undefined database type")
 	}
+
+	return startSchedulers(cfg, pubsubManager)
+}
+
+// Reconcile recreates the realtimer triggers of a table, used when its
+// schema changed after the triggers were installed
+func Reconcile(cfg config.DBConfig, tableName string) error {
+	for _, table := range cfg.Tables {
+		if table.Name != tableName {
+			continue
+		}
+
+		if cfg.Database.Type == "postgres" {
+			return reconcilePostgresTable(table)
+		} else if cfg.Database.Type == "mysql" {
+			return reconcileMySqlTable(table, cfg)
+		} else if cfg.Database.Type == "sqlite" {
+			return reconcileSQLiteTable(table)
+		}
+	}
+
+	return nil
+}
+
+// Query runs a read query on the database and returns its rows, only sql
+// databases can be queried
+func Query(query string, args ...interface{}) ([]map[string]string, error) {
+	if db == nil {
+		return nil, errors.New("the database type can not be queried")
+	}
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanRows(rows)
+}
+
+// Lookup returns the columns of the row of a table whose key column has the
+// given value, nil when there is none
+func Lookup(cfg config.DBConfig, table string, key string, value string, columns []string) (map[string]string, error) {
+	query := fmt.Sprintf("SELECT %s FROM %s WHERE %s = %s", strings.Join(columns, ", "), table, key, bindVar(cfg, 1))
+
+	rows, err := Query(query, value)
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, nil
+	}
+
+	return rows[0], nil
+}
+
+// bindVar returns the n-th (1-based) query placeholder for the configured database
+func bindVar(cfg config.DBConfig, n int) string {
+	if cfg.Database.Type == "postgres" {
+		return fmt.Sprintf("$%d", n)
+	}
+	return "?"
+}
+
+// scanRows reads every row of the result set into a column name to value map,
+// using the same "NULL" marker for missing values as the triggers do
+func scanRows(rows *sql.Rows) ([]map[string]string, error) {
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+
+	var result []map[string]string
+	for rows.Next() {
+		values := make([]sql.NullString, len(columns))
+		dest := make([]interface{}, len(columns))
+		for i := range values {
+			dest[i] = &values[i]
+		}
+
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+
+		row := make(map[string]string, len(columns))
+		for i, column := range columns {
+			if values[i].Valid {
+				row[column] = values[i].String
+			} else {
+				row[column] = "NULL"
+			}
+		}
+		result = append(result, row)
+	}
+
+	return result, rows.Err()
 }
 
 // Helper function to check if a table is in the config
@@ -44,3 +156,29 @@ func isTableInConfig(triggerName string, tables []config.Table) bool {
 	}
 	return false
 }
+
+// flattenJSONRow turns a decoded JSON object into the flat string map
+// published by the trigger based adapters, nested objects and arrays are
+// kept as JSON
+func flattenJSONRow(fields map[string]interface{}) map[string]string {
+	row := make(map[string]string, len(fields))
+	for column, value := range fields {
+		switch v := value.(type) {
+		case nil:
+			row[column] = "NULL"
+		case string:
+			row[column] = v
+		case map[string]interface{}, []interface{}:
+			encoded, err := json.Marshal(v)
+			if err != nil {
+				row[column] = fmt.Sprint(v)
+			} else {
+				row[column] = string(encoded)
+			}
+		default:
+			row[column] = fmt.Sprint(v)
+		}
+	}
+
+	return row
+}
@@ -0,0 +1,192 @@
+package adapters
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"realtimer/internal/config"
+	"realtimer/internal/pubsub"
+	"strings"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+const (
+	defaultDebeziumGroupId = "realtimer"
+	debeziumRetryDelay     = time.Second
+	debeziumMaxRetryDelay  = 30 * time.Second
+)
+
+// debeziumOperations maps the Debezium op codes to the realtimer operations,
+// snapshot reads are kept apart from inserts so a connector snapshot does not
+// flood insert subscribers unless READ is configured
+var debeziumOperations = map[string]string{
+	"c": "INSERT",
+	"u": "UPDATE",
+	"d": "DELETE",
+	"r": "READ",
+	"t": "TRUNCATE",
+}
+
+type debeziumChange struct {
+	Before map[string]interface{} `json:"before"`
+	After  map[string]interface{} `json:"after"`
+	Op     string                 `json:"op"`
+}
+
+// A debezium source does not touch the database at all, it consumes the
+// change events Debezium already writes to Kafka. Every table reads the
+// <kafka.topic_prefix>.<name> topic unless it sets its own topic, and offsets
+// are committed to the consumer group once the event was published.
+func newDebeziumAdapter(cfg config.DBConfig, pubsubManager *pubsub.SubscriptionManager) (*kafka.Reader, error) {
+	if len(cfg.Kafka.Brokers) == 0 {
+		return nil, errors.New("debezium source needs at least one kafka broker")
+	}
+
+	// kafka topic to table
+	tables := make(map[string]config.Table)
+	var topics []string
+	for _, table := range cfg.Tables {
+		topic := table.Topic
+		if topic == "" {
+			topic = fmt.Sprintf("%s.%s", cfg.Kafka.TopicPrefix, table.Name)
+		}
+
+		tables[topic] = table
+		topics = append(topics, topic)
+	}
+
+	if len(topics) == 0 {
+		return nil, nil
+	}
+
+	groupId := cfg.Kafka.GroupId
+	if groupId == "" {
+		groupId = defaultDebeziumGroupId
+	}
+
+	reader := kafka.NewReader(kafka.ReaderConfig{
+		Brokers:     cfg.Kafka.Brokers,
+		GroupID:     groupId,
+		GroupTopics: topics,
+	})
+
+	go consumeDebezium(reader, tables, pubsubManager)
+
+	return reader, nil
+}
+
+func consumeDebezium(reader *kafka.Reader, tables map[string]config.Table, pubsubManager *pubsub.SubscriptionManager) {
+	ctx := context.Background()
+
+	delay := debeziumRetryDelay
+	for {
+		message, err := reader.FetchMessage(ctx)
+		if err != nil {
+			// the reader was closed
+			if errors.Is(err, io.EOF) || ctx.Err() != nil {
+				return
+			}
+
+			log.Printf("error reading debezium topics, retrying in %s: %v", delay, err)
+			time.Sleep(delay)
+			delay = min(2*delay, debeziumMaxRetryDelay)
+			continue
+		}
+		delay = debeziumRetryDelay
+
+		table, ok := tables[message.Topic]
+		if ok {
+			publishDebeziumChange(table, message.Value, pubsubManager)
+		}
+
+		err = reader.CommitMessages(ctx, message)
+		if err != nil {
+			log.Printf("error committing debezium offset: %v", err)
+		}
+	}
+}
+
+func publishDebeziumChange(table config.Table, value []byte, pubsubManager *pubsub.SubscriptionManager) {
+	topic, row, err := debeziumEvent(table, value)
+	if err != nil {
+		log.Printf("error decoding debezium event for table %s: %v", table.Name, err)
+		return
+	}
+
+	if row != nil {
+		pubsubManager.Publish(topic, row)
+	}
+}
+
+// debeziumEvent maps a kafka record of a table to the topic and row it is
+// published as, row is nil when nothing is published: for tombstones and
+// operations the table does not configure
+func debeziumEvent(table config.Table, value []byte) (topic string, row map[string]string, err error) {
+	change, err := decodeDebeziumChange(value)
+	if err != nil {
+		return "", nil, err
+	}
+
+	// tombstones that follow deletes for log compaction
+	if change == nil {
+		return "", nil, nil
+	}
+
+	operation, ok := debeziumOperations[change.Op]
+	if !ok || !hasOperation(table, operation) {
+		return "", nil, nil
+	}
+
+	fields := change.After
+	if operation == "DELETE" {
+		fields = change.Before
+	}
+
+	topic = fmt.Sprintf("%s:%s", strings.ToLower(operation), table.Name)
+	return topic, flattenJSONRow(fields), nil
+}
+
+// decodeDebeziumChange reads an event written by the JSON converter, with or
+// without the schema envelope
+func decodeDebeziumChange(value []byte) (*debeziumChange, error) {
+	value = bytes.TrimSpace(value)
+	if len(value) == 0 || bytes.Equal(value, []byte("null")) {
+		return nil, nil
+	}
+
+	var envelope map[string]json.RawMessage
+	if err := json.Unmarshal(value, &envelope); err != nil {
+		return nil, err
+	}
+
+	if payload, ok := envelope["payload"]; ok {
+		if bytes.Equal(bytes.TrimSpace(payload), []byte("null")) {
+			return nil, nil
+		}
+		value = payload
+	}
+
+	var change debeziumChange
+	decoder := json.NewDecoder(bytes.NewReader(value))
+	decoder.UseNumber()
+	if err := decoder.Decode(&change); err != nil {
+		return nil, err
+	}
+
+	return &change, nil
+}
+
+func hasOperation(table config.Table, operation string) bool {
+	for _, op := range table.Operations {
+		if strings.EqualFold(op, operation) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,106 @@
+package adapters
+
+import (
+	"realtimer/internal/config"
+	"reflect"
+	"testing"
+)
+
+func TestDebeziumEvent(t *testing.T) {
+	table := config.Table{Name: "orders", Operations: []string{"INSERT", "UPDATE", "DELETE", "READ", "TRUNCATE"}}
+
+	tests := []struct {
+		name  string
+		value string
+		topic string
+		row   map[string]string
+	}{
+		{
+			name:  "insert",
+			value: `{"payload":{"before":null,"after":{"id":1,"status":"new","total":12.5},"op":"c"}}`,
+			topic: "insert:orders",
+			row:   map[string]string{"id": "1", "status": "new", "total": "12.5"},
+		},
+		{
+			name:  "update",
+			value: `{"payload":{"before":{"id":1,"status":"new"},"after":{"id":1,"status":"paid"},"op":"u"}}`,
+			topic: "update:orders",
+			row:   map[string]string{"id": "1", "status": "paid"},
+		},
+		{
+			name:  "delete",
+			value: `{"payload":{"before":{"id":1,"status":"paid"},"after":null,"op":"d"}}`,
+			topic: "delete:orders",
+			row:   map[string]string{"id": "1", "status": "paid"},
+		},
+		{
+			name:  "snapshot read",
+			value: `{"payload":{"before":null,"after":{"id":2,"note":null},"op":"r"}}`,
+			topic: "read:orders",
+			row:   map[string]string{"id": "2", "note": "NULL"},
+		},
+		{
+			name:  "truncate",
+			value: `{"payload":{"before":null,"after":null,"op":"t"}}`,
+			topic: "truncate:orders",
+			row:   map[string]string{},
+		},
+		{
+			name:  "schemas disabled",
+			value: `{"before":null,"after":{"id":3,"tags":["a","b"]},"op":"c"}`,
+			topic: "insert:orders",
+			row:   map[string]string{"id": "3", "tags": `["a","b"]`},
+		},
+		{
+			name:  "large number",
+			value: `{"before":null,"after":{"id":9007199254740993},"op":"c"}`,
+			topic: "insert:orders",
+			row:   map[string]string{"id": "9007199254740993"},
+		},
+		{
+			name:  "tombstone",
+			value: ``,
+		},
+		{
+			name:  "null payload",
+			value: `{"schema":null,"payload":null}`,
+		},
+		{
+			name:  "unknown op",
+			value: `{"payload":{"before":null,"after":{"id":1},"op":"m"}}`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			topic, row, err := debeziumEvent(table, []byte(test.value))
+			if err != nil {
+				t.Fatalf("debeziumEvent: %v", err)
+			}
+			if topic != test.topic || !reflect.DeepEqual(row, test.row) {
+				t.Errorf("debeziumEvent(%s) = %s %v, want %s %v", test.value, topic, row, test.topic, test.row)
+			}
+		})
+	}
+}
+
+func TestDebeziumEventNotConfigured(t *testing.T) {
+	table := config.Table{Name: "orders", Operations: []string{"INSERT"}}
+
+	for _, value := range []string{
+		`{"payload":{"before":{"id":1},"after":null,"op":"d"}}`,
+		`{"payload":{"before":null,"after":{"id":1},"op":"r"}}`,
+	} {
+		if topic, row, err := debeziumEvent(table, []byte(value)); err != nil || row != nil {
+			t.Errorf("debeziumEvent(%s) = %s %v %v, want nothing", value, topic, row, err)
+		}
+	}
+}
+
+func TestDebeziumEventInvalid(t *testing.T) {
+	table := config.Table{Name: "orders", Operations: []string{"INSERT"}}
+
+	if _, _, err := debeziumEvent(table, []byte(`{"payload":`)); err == nil {
+		t.Error("debeziumEvent of invalid json: no error")
+	}
+}
@@ -0,0 +1,236 @@
+package adapters
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"realtimer/internal/config"
+	"realtimer/internal/pubsub"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+const (
+	mongoResumeCollection = "realtimer_resume_tokens"
+	mongoResumeId         = "changes"
+	mongoRetryDelay       = time.Second
+	mongoMaxRetryDelay    = 30 * time.Second
+
+	// mongoHistoryLost is the server error of a resume token that is no longer
+	// in the oplog
+	mongoHistoryLost = 286
+)
+
+// mongoOperationTypes maps the configured operations to change stream
+// operation types, a replace rewrites the whole document and is published
+// as its own event
+var mongoOperationTypes = map[string]string{
+	"INSERT":  "insert",
+	"UPDATE":  "update",
+	"REPLACE": "replace",
+	"DELETE":  "delete",
+}
+
+type mongoChangeEvent struct {
+	OperationType string `bson:"operationType"`
+	Namespace     struct {
+		Coll string `bson:"coll"`
+	} `bson:"ns"`
+	FullDocument bson.Raw `bson:"fullDocument"`
+	DocumentKey  bson.Raw `bson:"documentKey"`
+}
+
+type mongoResumeState struct {
+	Token bson.Raw `bson:"token"`
+}
+
+// The configured tables are collections of the database, watched through a
+// single database change stream. The resume token is stored in the
+// realtimer_resume_tokens collection so a restart continues where the last
+// run stopped.
+func newMongoAdapter(cfg config.DBConfig, pubsubManager *pubsub.SubscriptionManager) (*mongo.Client, error) {
+	uri := url.URL{
+		Scheme: "mongodb",
+		Host:   fmt.Sprintf("%s:%s", cfg.Database.Host, strconv.Itoa(cfg.Database.Port)),
+		Path:   "/",
+	}
+	if cfg.Database.Username != "" {
+		uri.User = url.UserPassword(cfg.Database.Username, cfg.Database.Password)
+	}
+
+	client, err := mongo.Connect(options.Client().ApplyURI(uri.String()))
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	err = client.Ping(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to mongodb: %w", err)
+	}
+
+	var matches bson.A
+	for _, table := range cfg.Tables {
+		var operationTypes bson.A
+		for _, operation := range table.Operations {
+			operationType, ok := mongoOperationTypes[strings.ToUpper(operation)]
+			if !ok {
+				return nil, fmt.Errorf("unsupported operation %s for collection %s", operation, table.Name)
+			}
+			operationTypes = append(operationTypes, operationType)
+		}
+
+		matches = append(matches, bson.D{
+			{Key: "ns.coll", Value: table.Name},
+			{Key: "operationType", Value: bson.D{{Key: "$in", Value: operationTypes}}},
+		})
+	}
+
+	if len(matches) == 0 {
+		return client, nil
+	}
+
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.D{{Key: "$or", Value: matches}}}},
+	}
+
+	go watchMongo(client.Database(cfg.Database.Name), pipeline, pubsubManager)
+
+	return client, nil
+}
+
+// watchMongo keeps the change stream open, reopening it from the stored
+// resume token with a growing delay whenever it fails. Only a token the oplog
+// no longer has is given up, the stream then starts from the current position.
+func watchMongo(database *mongo.Database, pipeline mongo.Pipeline, pubsubManager *pubsub.SubscriptionManager) {
+	delay := mongoRetryDelay
+	for {
+		started := time.Now()
+		err := streamMongoChanges(database, pipeline, pubsubManager)
+
+		var serverErr mongo.ServerError
+		if errors.As(err, &serverErr) && serverErr.HasErrorCode(mongoHistoryLost) {
+			log.Printf("mongodb change stream history lost, changes since the stored position are skipped: %v", err)
+			_, err := database.Collection(mongoResumeCollection).DeleteOne(context.Background(), bson.D{{Key: "_id", Value: mongoResumeId}})
+			if err != nil {
+				log.Printf("error dropping mongodb resume token: %v", err)
+			}
+		} else {
+			log.Printf("mongodb change stream stopped: %v", err)
+		}
+
+		// a stream that ran for a while starts over with the shortest delay
+		if time.Since(started) > mongoMaxRetryDelay {
+			delay = mongoRetryDelay
+		}
+		time.Sleep(delay)
+		delay = min(2*delay, mongoMaxRetryDelay)
+	}
+}
+
+func streamMongoChanges(database *mongo.Database, pipeline mongo.Pipeline, pubsubManager *pubsub.SubscriptionManager) error {
+	ctx := context.Background()
+	resumeCollection := database.Collection(mongoResumeCollection)
+
+	opts := options.ChangeStream().SetFullDocument(options.UpdateLookup)
+
+	var state mongoResumeState
+	err := resumeCollection.FindOne(ctx, bson.D{{Key: "_id", Value: mongoResumeId}}).Decode(&state)
+	if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+		return fmt.Errorf("failed to load resume token: %w", err)
+	}
+
+	if state.Token != nil {
+		opts.SetResumeAfter(state.Token)
+	}
+
+	stream, err := database.Watch(ctx, pipeline, opts)
+	if err != nil {
+		return err
+	}
+	defer stream.Close(ctx)
+
+	for stream.Next(ctx) {
+		var change mongoChangeEvent
+		if err := stream.Decode(&change); err != nil {
+			log.Printf("error decoding mongodb change event: %v", err)
+			continue
+		}
+
+		// deletes only carry the document key, updates of a document that was
+		// deleted before the lookup have no full document either
+		document := change.FullDocument
+		if document == nil {
+			document = change.DocumentKey
+		}
+
+		row, err := flattenMongoDocument(document)
+		if err != nil {
+			log.Printf("error reading mongodb document: %v", err)
+			continue
+		}
+
+		topic := fmt.Sprintf("%s:%s", change.OperationType, change.Namespace.Coll)
+		pubsubManager.Publish(topic, row)
+
+		// store the position once per batch rather than once per event
+		if stream.RemainingBatchLength() == 0 {
+			_, err := resumeCollection.ReplaceOne(
+				ctx,
+				bson.D{{Key: "_id", Value: mongoResumeId}},
+				bson.D{{Key: "_id", Value: mongoResumeId}, {Key: "token", Value: stream.ResumeToken()}},
+				options.Replace().SetUpsert(true),
+			)
+			if err != nil {
+				log.Printf("error storing mongodb resume token: %v", err)
+			}
+		}
+	}
+
+	return stream.Err()
+}
+
+// flattenMongoDocument turns the top level fields of a document into the flat
+// string map published by the SQL adapters, nested documents and arrays are
+// kept as extended JSON
+func flattenMongoDocument(document bson.Raw) (map[string]string, error) {
+	elements, err := document.Elements()
+	if err != nil {
+		return nil, err
+	}
+
+	row := make(map[string]string, len(elements))
+	for _, element := range elements {
+		value := element.Value()
+
+		switch value.Type {
+		case bson.TypeNull, bson.TypeUndefined:
+			row[element.Key()] = "NULL"
+		case bson.TypeString:
+			row[element.Key()] = value.StringValue()
+		case bson.TypeObjectID:
+			row[element.Key()] = value.ObjectID().Hex()
+		case bson.TypeBoolean:
+			row[element.Key()] = strconv.FormatBool(value.Boolean())
+		case bson.TypeInt32, bson.TypeInt64:
+			row[element.Key()] = strconv.FormatInt(value.AsInt64(), 10)
+		case bson.TypeDouble:
+			row[element.Key()] = strconv.FormatFloat(value.Double(), 'f', -1, 64)
+		case bson.TypeDateTime:
+			row[element.Key()] = value.Time().UTC().Format(time.RFC3339Nano)
+		default:
+			row[element.Key()] = value.String()
+		}
+	}
+
+	return row, nil
+}
@@ -133,6 +133,26 @@ func dropMySqlTrigger(triggerName, dbName string) error {
 	return nil
 }
 
+// reconcileMySqlTable recreates the triggers of a table so the row data they
+// send matches its current columns
+func reconcileMySqlTable(table config.Table, cfg config.DBConfig) error {
+	for _, operation := range table.Operations {
+		triggerName := fmt.Sprintf("realtimer_trigger_%s_%s", strings.ToLower(operation), table.Name)
+
+		err := dropMySqlTrigger(triggerName, cfg.Database.Name)
+		if err != nil {
+			return fmt.Errorf("failed to drop trigger %s: %w", triggerName, err)
+		}
+
+		err = createMySqlTriggerForTable(table.Name, operation, cfg)
+		if err != nil {
+			return fmt.Errorf("failed to recreate trigger for table %s: %w", table.Name, err)
+		}
+	}
+
+	return nil
+}
+
 // +-----------+-----+-------------------------+----------+
 // | name      | ret | dl                      | type     |
 // +-----------+-----+-------------------------+----------+
@@ -3,21 +3,25 @@ package adapters
 import (
 	"archive/zip"
 	"database/sql"
+	"encoding/json"
 	"fmt"
 	"io"
+	"log"
 	"net/http"
 	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"realtimer/internal/config"
+	"realtimer/internal/pubsub"
 	"strconv"
 	"strings"
+	"time"
 
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 )
 
-func newPostgresAdapter(cfg config.DBConfig) (*sql.DB, error) {
+func newPostgresAdapter(cfg config.DBConfig, pubsubManager *pubsub.SubscriptionManager) (*sql.DB, error) {
 
 	host := fmt.Sprintf("%s:%s", cfg.Database.Host, strconv.Itoa(cfg.Database.Port))
 
@@ -58,6 +62,19 @@ func newPostgresAdapter(cfg config.DBConfig) (*sql.DB, error) {
 		return nil, err
 	}
 
+	if cfg.Database.SchemaEvents {
+		err = initPostgresSchemaTrigger(cfg)
+	} else {
+		err = dropPostgresSchemaTrigger()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.Database.SchemaEvents {
+		go listenPostgresSchema(cfg, dsn.String(), pubsubManager)
+	}
+
 	return db, nil
 }
 
@@ -344,3 +361,151 @@ func createPostgresTrigger(tableName string, operation string) error {
 
 	return nil
 }
+
+// schemaChannel is the channel the event triggers notify of DDL on
+const schemaChannel = "realtimer_schema"
+
+// initPostgresSchemaTrigger installs event triggers that notify the service
+// of DDL on the configured tables, the notification is only delivered once
+// the DDL is committed
+func initPostgresSchemaTrigger(cfg config.DBConfig) error {
+	var tableNames []string
+	for _, table := range cfg.Tables {
+		tableNames = append(tableNames, fmt.Sprintf("'%s'", strings.ReplaceAll(table.Name, "'", "''")))
+	}
+
+	initFunctionQuery := fmt.Sprintf(
+		`CREATE OR REPLACE FUNCTION realtimer_schema_trigger() RETURNS event_trigger AS $$
+		DECLARE
+			obj record;
+			table_name TEXT;
+		BEGIN
+			FOR obj IN
+				SELECT object_type, object_identity FROM pg_event_trigger_ddl_commands() WHERE TG_EVENT = 'ddl_command_end'
+				UNION ALL
+				SELECT object_type, object_identity FROM pg_event_trigger_dropped_objects() WHERE TG_EVENT = 'sql_drop'
+			LOOP
+				CONTINUE WHEN obj.object_type NOT IN ('table', 'table column');
+
+				table_name := split_part(obj.object_identity, '.', 2);
+				CONTINUE WHEN NOT (table_name = ANY(ARRAY[%s]::TEXT[]));
+
+				PERFORM pg_notify('%s', json_build_object(
+					'table', table_name,
+					'command_tag', TG_TAG,
+					'object_type', obj.object_type,
+					'object_identity', obj.object_identity
+				)::text);
+			END LOOP;
+		END;
+		$$ LANGUAGE plpgsql;`,
+		strings.Join(tableNames, ", "),
+		schemaChannel,
+	)
+
+	_, err := db.Exec(initFunctionQuery)
+	if err != nil {
+		return fmt.Errorf("failed to create schema trigger function: %w", err)
+	}
+
+	err = dropPostgresSchemaTrigger()
+	if err != nil {
+		return err
+	}
+
+	for _, event := range []string{"ddl_command_end", "sql_drop"} {
+		createEventTriggerQuery := fmt.Sprintf(
+			"CREATE EVENT TRIGGER realtimer_schema_%s ON %s EXECUTE FUNCTION realtimer_schema_trigger();",
+			event,
+			event,
+		)
+
+		_, err = db.Exec(createEventTriggerQuery)
+		if err != nil {
+			return fmt.Errorf("failed to create %s event trigger: %w", event, err)
+		}
+	}
+
+	return nil
+}
+
+func dropPostgresSchemaTrigger() error {
+	for _, event := range []string{"ddl_command_end", "sql_drop"} {
+		_, err := db.Exec(fmt.Sprintf("DROP EVENT TRIGGER IF EXISTS realtimer_schema_%s;", event))
+		if err != nil {
+			return fmt.Errorf("failed to drop %s event trigger: %w", event, err)
+		}
+	}
+
+	return nil
+}
+
+// listenPostgresSchema publishes the DDL the event triggers notify of as
+// schema events and recreates the triggers of the changed table. It runs in
+// the adapter so the public callback cannot ask for it.
+func listenPostgresSchema(cfg config.DBConfig, dsn string, pubsubManager *pubsub.SubscriptionManager) {
+	listener := pq.NewListener(dsn, time.Second, time.Minute, func(event pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Printf("error listening for postgres schema changes: %v", err)
+		}
+	})
+	defer listener.Close()
+
+	if err := listener.Listen(schemaChannel); err != nil {
+		log.Printf("error listening for postgres schema changes: %v", err)
+		return
+	}
+
+	for notification := range listener.Notify {
+		// nil after a reconnection, changes in between are missed
+		if notification == nil {
+			log.Printf("reconnected to postgres, schema changes made while disconnected were missed")
+			continue
+		}
+
+		var change struct {
+			Table          string `json:"table"`
+			CommandTag     string `json:"command_tag"`
+			ObjectType     string `json:"object_type"`
+			ObjectIdentity string `json:"object_identity"`
+		}
+		if err := json.Unmarshal([]byte(notification.Extra), &change); err != nil {
+			log.Printf("error decoding postgres schema change %q: %v", notification.Extra, err)
+			continue
+		}
+
+		pubsubManager.Publish(pubsub.EventTopic("SCHEMA", change.Table), map[string]string{
+			"command_tag":     change.CommandTag,
+			"object_type":     change.ObjectType,
+			"object_identity": change.ObjectIdentity,
+		})
+
+		if err := Reconcile(cfg, change.Table); err != nil {
+			log.Printf("error reconciling triggers of table %s: %v", change.Table, err)
+		}
+	}
+}
+
+// reconcilePostgresTable recreates the triggers of a table after its schema
+// changed so the row data they send matches the new columns
+func reconcilePostgresTable(table config.Table) error {
+	// the notification comes after the DDL is committed, a dropped table
+	// took its triggers with it
+	var exists bool
+	err := db.QueryRow("SELECT to_regclass($1) IS NOT NULL", table.Name).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return nil
+	}
+
+	for _, operation := range table.Operations {
+		err := createPostgresTrigger(table.Name, operation)
+		if err != nil {
+			return fmt.Errorf("failed to recreate trigger for table %s: %w", table.Name, err)
+		}
+	}
+
+	return nil
+}
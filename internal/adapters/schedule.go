@@ -0,0 +1,295 @@
+package adapters
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"realtimer/internal/config"
+	"realtimer/internal/pubsub"
+	"strings"
+	"time"
+)
+
+const (
+	defaultSchedulePollInterval = time.Second
+	defaultScheduleLag          = time.Minute
+)
+
+// scheduler publishes a due:<table> event for every row whose schedule column
+// has been reached. The database time of the last poll is stored in the
+// realtimer_schedules table, so restarts pick up rows that became due while
+// the service was down. Every poll scans again the lag before it, for rows
+// committed late or scheduled just before it, and the rows fired there are
+// kept in realtimer_schedule_fired so they are not published twice. Rows
+// that are rescheduled or deleted are handled by simply querying the table
+// again.
+type scheduler struct {
+	cfg           config.DBConfig
+	table         config.Table
+	pubsubManager *pubsub.SubscriptionManager
+	watermark     string
+	lag           time.Duration
+}
+
+func startSchedulers(cfg config.DBConfig, pubsubManager *pubsub.SubscriptionManager) error {
+	var scheduled []config.Table
+	for _, table := range cfg.Tables {
+		if table.Schedule != nil {
+			scheduled = append(scheduled, table)
+		}
+	}
+
+	if len(scheduled) == 0 {
+		return nil
+	}
+
+	if db == nil {
+		return errors.New("schedules are only supported for sql databases")
+	}
+
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS realtimer_schedules (
+		table_name VARCHAR(255) NOT NULL PRIMARY KEY,
+		fired_until VARCHAR(64) NOT NULL
+	)`)
+	if err != nil {
+		return fmt.Errorf("failed to create schedule state table: %w", err)
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS realtimer_schedule_fired (
+		table_name VARCHAR(255) NOT NULL,
+		row_key VARCHAR(255) NOT NULL,
+		run_at VARCHAR(64) NOT NULL,
+		PRIMARY KEY (table_name, row_key, run_at)
+	)`)
+	if err != nil {
+		return fmt.Errorf("failed to create schedule state table: %w", err)
+	}
+
+	for _, table := range scheduled {
+		if table.Schedule.Column == "" {
+			return fmt.Errorf("schedule for table %s has no column", table.Name)
+		}
+
+		s := &scheduler{
+			cfg:           cfg,
+			table:         table,
+			pubsubManager: pubsubManager,
+			lag:           table.Schedule.Lag,
+		}
+		if s.lag <= 0 {
+			s.lag = defaultScheduleLag
+		}
+
+		err := s.loadWatermark()
+		if err != nil {
+			return fmt.Errorf("failed to load schedule state for table %s: %w", table.Name, err)
+		}
+
+		go s.run()
+	}
+
+	return nil
+}
+
+func (s *scheduler) run() {
+	interval := s.table.Schedule.PollInterval
+	if interval <= 0 {
+		interval = defaultSchedulePollInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := s.fireDue(); err != nil {
+			log.Printf("error firing scheduled rows of table %s: %v", s.table.Name, err)
+		}
+		<-ticker.C
+	}
+}
+
+// loadWatermark restores the last published position, starting from the
+// current database time the first time a table is scheduled
+func (s *scheduler) loadWatermark() error {
+	err := db.QueryRow(
+		fmt.Sprintf("SELECT fired_until FROM realtimer_schedules WHERE table_name = %s", bindVar(s.cfg, 1)),
+		s.table.Name,
+	).Scan(&s.watermark)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		now, err := s.dbNow()
+		if err != nil {
+			return err
+		}
+		return s.saveWatermark(now)
+	}
+
+	return err
+}
+
+func (s *scheduler) saveWatermark(watermark string) error {
+	var query string
+	if s.cfg.Database.Type == "mysql" {
+		query = `INSERT INTO realtimer_schedules (table_name, fired_until) VALUES (?, ?)
+			ON DUPLICATE KEY UPDATE fired_until = VALUES(fired_until)`
+	} else {
+		query = fmt.Sprintf(
+			`INSERT INTO realtimer_schedules (table_name, fired_until) VALUES (%s, %s)
+			ON CONFLICT (table_name) DO UPDATE SET fired_until = EXCLUDED.fired_until`,
+			bindVar(s.cfg, 1),
+			bindVar(s.cfg, 2),
+		)
+	}
+
+	_, err := db.Exec(query, s.table.Name, watermark)
+	if err != nil {
+		return err
+	}
+
+	s.watermark = watermark
+	return nil
+}
+
+// dbNow uses the database clock so the comparison with the schedule column
+// is not affected by clock skew or time zone differences with this host
+func (s *scheduler) dbNow() (string, error) {
+	query := "SELECT NOW(6)"
+	if s.cfg.Database.Type == "postgres" {
+		query = "SELECT CURRENT_TIMESTAMP"
+	} else if s.cfg.Database.Type == "sqlite" {
+		// SQLite stores timestamps as text, compared in this same format
+		query = "SELECT strftime('%Y-%m-%d %H:%M:%f', 'now')"
+	}
+
+	var now string
+	err := db.QueryRow(query).Scan(&now)
+	return now, err
+}
+
+// lagged returns the SQL of a timestamp parameter moved back by the lag
+func (s *scheduler) lagged(param string) string {
+	switch s.cfg.Database.Type {
+	case "postgres":
+		return fmt.Sprintf("(%s::timestamptz - interval '%d microseconds')", param, s.lag.Microseconds())
+	case "sqlite":
+		return fmt.Sprintf("strftime('%%Y-%%m-%%d %%H:%%M:%%f', %s, '-%f seconds')", param, s.lag.Seconds())
+	default:
+		return fmt.Sprintf("DATE_SUB(%s, INTERVAL %d MICROSECOND)", param, s.lag.Microseconds())
+	}
+}
+
+func (s *scheduler) fireDue() error {
+	now, err := s.dbNow()
+	if err != nil {
+		return err
+	}
+
+	upper := bindVar(s.cfg, 2)
+	if s.cfg.Database.Type == "postgres" {
+		upper += "::timestamptz"
+	}
+
+	dueQuery := fmt.Sprintf(
+		"SELECT * FROM %s WHERE %s > %s AND %s <= %s ORDER BY %s",
+		s.table.Name,
+		s.table.Schedule.Column, s.lagged(bindVar(s.cfg, 1)),
+		s.table.Schedule.Column, upper,
+		s.table.Schedule.Column,
+	)
+
+	rows, err := db.Query(dueQuery, s.watermark, now)
+	if err != nil {
+		return err
+	}
+	due, err := scanRows(rows)
+	rows.Close()
+	if err != nil {
+		return err
+	}
+
+	fired, err := s.loadFired()
+	if err != nil {
+		return err
+	}
+
+	topic := fmt.Sprintf("due:%s", s.table.Name)
+	scanned := make(map[firedRow]bool, len(due))
+	for _, row := range due {
+		key := firedRow{key: s.rowKey(row), runAt: row[s.table.Schedule.Column]}
+		scanned[key] = true
+		if fired[key] {
+			continue
+		}
+
+		s.pubsubManager.Publish(topic, row)
+		if err := s.execFired("INSERT INTO realtimer_schedule_fired (table_name, row_key, run_at) VALUES (%s, %s, %s)", key); err != nil {
+			return err
+		}
+	}
+
+	// rows that left the scanned window are not scanned again
+	for key := range fired {
+		if !scanned[key] {
+			if err := s.execFired("DELETE FROM realtimer_schedule_fired WHERE table_name = %s AND row_key = %s AND run_at = %s", key); err != nil {
+				return err
+			}
+		}
+	}
+
+	return s.saveWatermark(now)
+}
+
+// firedRow is a row published at one value of its schedule column, it fires
+// again when it is rescheduled
+type firedRow struct {
+	key   string
+	runAt string
+}
+
+func (s *scheduler) loadFired() (map[firedRow]bool, error) {
+	rows, err := db.Query(
+		fmt.Sprintf("SELECT row_key, run_at FROM realtimer_schedule_fired WHERE table_name = %s", bindVar(s.cfg, 1)),
+		s.table.Name,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	fired := make(map[firedRow]bool)
+	for rows.Next() {
+		var key firedRow
+		if err := rows.Scan(&key.key, &key.runAt); err != nil {
+			return nil, err
+		}
+		fired[key] = true
+	}
+
+	return fired, rows.Err()
+}
+
+func (s *scheduler) execFired(query string, key firedRow) error {
+	_, err := db.Exec(
+		fmt.Sprintf(query, bindVar(s.cfg, 1), bindVar(s.cfg, 2), bindVar(s.cfg, 3)),
+		s.table.Name, key.key, key.runAt,
+	)
+	return err
+}
+
+// rowKey returns the primary key values of a row, query escaped and joined
+// with ','
+func (s *scheduler) rowKey(row map[string]string) string {
+	columns := s.table.PrimaryKey
+	if len(columns) == 0 {
+		columns = []string{"id"}
+	}
+
+	values := make([]string, len(columns))
+	for i, column := range columns {
+		values[i] = url.QueryEscape(row[column])
+	}
+
+	return strings.Join(values, ",")
+}
@@ -0,0 +1,282 @@
+package adapters
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"realtimer/internal/config"
+	"realtimer/internal/pubsub"
+	"strings"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+const (
+	defaultOutboxPollInterval = 200 * time.Millisecond
+	outboxBatchSize           = 500
+)
+
+// SQLite has no way to call out of a trigger, so the triggers append the row
+// to the realtimer_outbox table and the service polls it, publishing every
+// entry under the same topics and payload format as the MySQL/Postgres
+// callbacks before deleting it.
+func newSQLiteAdapter(cfg config.DBConfig, pubsubManager *pubsub.SubscriptionManager) (*sql.DB, error) {
+	// the application writes to the same file, wait for its locks instead of
+	// failing with SQLITE_BUSY
+	dsn := cfg.Database.Name
+	if strings.Contains(dsn, "?") {
+		dsn += "&_pragma=busy_timeout(5000)"
+	} else {
+		dsn += "?_pragma=busy_timeout(5000)"
+	}
+
+	var err error
+	db, err = sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	// the outbox poller and the schedulers share one connection, SQLite only
+	// allows a single writer anyway
+	db.SetMaxOpenConns(1)
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS realtimer_outbox (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		table_name TEXT NOT NULL,
+		event TEXT NOT NULL,
+		row_data TEXT NOT NULL
+	)`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create outbox table: %w", err)
+	}
+
+	err = initSQLiteTriggers(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	go pollSQLiteOutbox(cfg, pubsubManager)
+
+	return db, nil
+}
+
+func initSQLiteTriggers(cfg config.DBConfig) error {
+	rows, err := db.Query("SELECT name, tbl_name FROM sqlite_master WHERE type = 'trigger' AND name LIKE 'realtimer_trigger_%';")
+	if err != nil {
+		return err
+	}
+
+	existingTriggers := make(map[string]string)
+	for rows.Next() {
+		var triggerName, tableName string
+
+		if err := rows.Scan(&triggerName, &tableName); err != nil {
+			rows.Close()
+			return err
+		}
+
+		existingTriggers[triggerName] = tableName
+	}
+	rows.Close()
+
+	// Loop over tables in config and check if triggers need to be created
+	for _, table := range cfg.Tables {
+		for _, operation := range table.Operations {
+			key := fmt.Sprintf("realtimer_trigger_%s_%s", strings.ToLower(operation), table.Name)
+
+			_, exists := existingTriggers[key]
+			if !exists {
+				// Trigger does not exist, so create it
+				err := createSQLiteTrigger(table.Name, operation)
+				if err != nil {
+					return fmt.Errorf("failed to create trigger for table %s: %w", table.Name, err)
+				}
+			}
+		}
+	}
+
+	// Loop over existing triggers and drop those not in the current config
+	for triggerName := range existingTriggers {
+		if !isTableInConfig(triggerName, cfg.Tables) {
+			// Trigger exists but is not in the current config, so drop it
+			err := dropSQLiteTrigger(triggerName)
+			if err != nil {
+				return fmt.Errorf("failed to drop trigger %s: %w", triggerName, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+func dropSQLiteTrigger(triggerName string) error {
+	_, err := db.Exec(fmt.Sprintf("DROP TRIGGER IF EXISTS %s", triggerName))
+	return err
+}
+
+func createSQLiteTrigger(tableName string, operation string) error {
+	// pragma_table_info cannot be parameterised through the driver, the table
+	// name comes from the config just like for the other adapters
+	cols, err := db.Query(fmt.Sprintf("SELECT name FROM pragma_table_info('%s');", tableName))
+	if err != nil {
+		return fmt.Errorf("failed to read columns of table %s: %w", tableName, err)
+	}
+
+	var columns []string
+	for cols.Next() {
+		var column string
+		if err := cols.Scan(&column); err != nil {
+			cols.Close()
+			return err
+		}
+		columns = append(columns, column)
+	}
+	cols.Close()
+
+	if len(columns) == 0 {
+		return fmt.Errorf("table %s does not exist", tableName)
+	}
+
+	operation = strings.ToUpper(operation)
+	record := "NEW"
+	if operation == "DELETE" {
+		record = "OLD"
+	}
+
+	var jsonFields []string
+	for _, column := range columns {
+		jsonFields = append(jsonFields, fmt.Sprintf("'%s', %s.%s", column, record, column))
+	}
+
+	createTriggerQuery := fmt.Sprintf(
+		`CREATE TRIGGER realtimer_trigger_%s_%s AFTER %s ON %s
+		FOR EACH ROW
+		BEGIN
+			INSERT INTO realtimer_outbox (table_name, event, row_data)
+			VALUES ('%s', '%s', json_object(%s));
+		END;`,
+		strings.ToLower(operation),
+		tableName,
+		operation,
+		tableName,
+		tableName,
+		operation,
+		strings.Join(jsonFields, ", "),
+	)
+
+	_, err = db.Exec(createTriggerQuery)
+	if err != nil {
+		return fmt.Errorf("error creating %s trigger: %w", strings.ToLower(operation), err)
+	}
+
+	return nil
+}
+
+// reconcileSQLiteTable recreates the triggers of a table so the row data they
+// write matches its current columns
+func reconcileSQLiteTable(table config.Table) error {
+	for _, operation := range table.Operations {
+		triggerName := fmt.Sprintf("realtimer_trigger_%s_%s", strings.ToLower(operation), table.Name)
+
+		err := dropSQLiteTrigger(triggerName)
+		if err != nil {
+			return fmt.Errorf("failed to drop trigger %s: %w", triggerName, err)
+		}
+
+		err = createSQLiteTrigger(table.Name, operation)
+		if err != nil {
+			return fmt.Errorf("failed to recreate trigger for table %s: %w", table.Name, err)
+		}
+	}
+
+	return nil
+}
+
+func pollSQLiteOutbox(cfg config.DBConfig, pubsubManager *pubsub.SubscriptionManager) {
+	interval := cfg.Database.PollInterval
+	if interval <= 0 {
+		interval = defaultOutboxPollInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		for {
+			n, err := drainSQLiteOutbox(pubsubManager)
+			if err != nil {
+				log.Printf("error reading sqlite outbox: %v", err)
+				break
+			}
+
+			if n < outboxBatchSize {
+				break
+			}
+		}
+	}
+}
+
+// drainSQLiteOutbox publishes one batch of outbox entries and removes them,
+// returning how many entries were handled
+func drainSQLiteOutbox(pubsubManager *pubsub.SubscriptionManager) (int, error) {
+	rows, err := db.Query("SELECT id, table_name, event, row_data FROM realtimer_outbox ORDER BY id LIMIT ?", outboxBatchSize)
+	if err != nil {
+		return 0, err
+	}
+
+	type outboxEntry struct {
+		id      int64
+		table   string
+		event   string
+		rowData string
+	}
+
+	var entries []outboxEntry
+	for rows.Next() {
+		var entry outboxEntry
+		if err := rows.Scan(&entry.id, &entry.table, &entry.event, &entry.rowData); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		entries = append(entries, entry)
+	}
+	rows.Close()
+
+	if len(entries) == 0 {
+		return 0, nil
+	}
+
+	for _, entry := range entries {
+		row, err := decodeOutboxRow(entry.rowData)
+		if err != nil {
+			log.Printf("error decoding outbox entry %d: %v", entry.id, err)
+			continue
+		}
+
+		topic := fmt.Sprintf("%s:%s", strings.ToLower(entry.event), entry.table)
+		pubsubManager.Publish(topic, row)
+	}
+
+	_, err = db.Exec("DELETE FROM realtimer_outbox WHERE id <= ?", entries[len(entries)-1].id)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(entries), nil
+}
+
+// decodeOutboxRow turns the json_object written by the trigger into the flat
+// string map published by the other adapters
+func decodeOutboxRow(rowData string) (map[string]string, error) {
+	var fields map[string]interface{}
+
+	decoder := json.NewDecoder(strings.NewReader(rowData))
+	decoder.UseNumber()
+	if err := decoder.Decode(&fields); err != nil {
+		return nil, err
+	}
+
+	return flattenJSONRow(fields), nil
+}
@@ -0,0 +1,289 @@
+package aggregate
+
+import (
+	"fmt"
+	"math"
+	"realtimer/internal/config"
+	"realtimer/internal/pubsub"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TopicPrefix starts the topics aggregates are published on
+const TopicPrefix = "aggregate:"
+
+// function is one aggregate of a stream, over column unless it counts
+type function struct {
+	name   string // count, sum, min or max
+	column string
+}
+
+func (f function) key() string {
+	if f.name == "count" {
+		return f.name
+	}
+	return f.name + "_" + f.column
+}
+
+// partial holds the aggregates of one group over one slide of a window
+type partial struct {
+	count int
+	sum   map[string]float64
+	min   map[string]float64
+	max   map[string]float64
+}
+
+func newPartial() *partial {
+	return &partial{
+		sum: make(map[string]float64),
+		min: make(map[string]float64),
+		max: make(map[string]float64),
+	}
+}
+
+// stream aggregates the events of a topic. Time is cut into slides, a window
+// is made of the last window/slide of them and closes at the end of every
+// slide, tumbling windows have a single slide.
+type stream struct {
+	cfg       config.Aggregate
+	topic     string
+	functions []function
+	slide     time.Duration
+
+	mu      sync.Mutex
+	buckets []map[string]*partial // by group, the last one is the current slide
+}
+
+// Start runs the configured aggregate streams, their aggregates are
+// published on aggregate:<name>
+func Start(cfg config.DBConfig, pubsubManager *pubsub.SubscriptionManager) error {
+	var streams []*stream
+	for _, aggregate := range cfg.Aggregates {
+		s, err := newStream(aggregate)
+		if err != nil {
+			return fmt.Errorf("invalid aggregate %s: %w", aggregate.Name, err)
+		}
+		streams = append(streams, s)
+	}
+
+	if len(streams) == 0 {
+		return nil
+	}
+
+	pubsubManager.Watch(func(topic string, message map[string]string) {
+		for _, s := range streams {
+			if topic != s.topic && pubsub.MatchTopic(s.cfg.Topic, topic) {
+				s.add(message)
+			}
+		}
+	})
+
+	for _, s := range streams {
+		go s.run(pubsubManager)
+	}
+
+	return nil
+}
+
+func newStream(cfg config.Aggregate) (*stream, error) {
+	if cfg.Name == "" || cfg.Topic == "" {
+		return nil, fmt.Errorf("name and topic are required")
+	}
+	if cfg.Window <= 0 {
+		return nil, fmt.Errorf("window is required")
+	}
+
+	slide := cfg.Slide
+	if slide <= 0 {
+		slide = cfg.Window
+	}
+	if cfg.Window%slide != 0 {
+		return nil, fmt.Errorf("window has to be a multiple of slide")
+	}
+
+	s := &stream{
+		cfg:     cfg,
+		topic:   TopicPrefix + cfg.Name,
+		slide:   slide,
+		buckets: make([]map[string]*partial, cfg.Window/slide),
+	}
+	for i := range s.buckets {
+		s.buckets[i] = make(map[string]*partial)
+	}
+
+	for _, spec := range cfg.Functions {
+		f, err := parseFunction(spec)
+		if err != nil {
+			return nil, err
+		}
+		s.functions = append(s.functions, f)
+	}
+	if len(s.functions) == 0 {
+		return nil, fmt.Errorf("functions are required")
+	}
+
+	return s, nil
+}
+
+// parseFunction reads count, sum(column), min(column) or max(column)
+func parseFunction(spec string) (function, error) {
+	spec = strings.TrimSpace(spec)
+	if spec == "count" {
+		return function{name: "count"}, nil
+	}
+
+	name, rest, ok := strings.Cut(spec, "(")
+	column, ok2 := strings.CutSuffix(rest, ")")
+	if !ok || !ok2 || column == "" {
+		return function{}, fmt.Errorf("invalid function %q", spec)
+	}
+
+	switch name {
+	case "sum", "min", "max":
+		return function{name: name, column: strings.TrimSpace(column)}, nil
+	}
+
+	return function{}, fmt.Errorf("unknown function %q", name)
+}
+
+// add counts an event into the current slide
+func (s *stream) add(message map[string]string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	group := ""
+	if s.cfg.GroupBy != "" {
+		group = message[s.cfg.GroupBy]
+	}
+
+	current := s.buckets[len(s.buckets)-1]
+	p, ok := current[group]
+	if !ok {
+		p = newPartial()
+		current[group] = p
+	}
+
+	p.count++
+	for _, f := range s.functions {
+		if f.name == "count" {
+			continue
+		}
+
+		value, err := strconv.ParseFloat(message[f.column], 64)
+		if err != nil {
+			// NULL and non numeric values are left out
+			continue
+		}
+
+		switch f.name {
+		case "sum":
+			p.sum[f.column] += value
+		case "min":
+			if current, ok := p.min[f.column]; !ok || value < current {
+				p.min[f.column] = value
+			}
+		case "max":
+			if current, ok := p.max[f.column]; !ok || value > current {
+				p.max[f.column] = value
+			}
+		}
+	}
+}
+
+// run closes a window at the end of every slide, aligned to the clock
+func (s *stream) run(pubsubManager *pubsub.SubscriptionManager) {
+	for {
+		end := time.Now().Truncate(s.slide).Add(s.slide)
+		time.Sleep(time.Until(end))
+
+		for _, message := range s.close(end) {
+			pubsubManager.Publish(s.topic, message)
+		}
+	}
+}
+
+// close merges the slides of the window ending at end into one message per
+// group and starts the next slide
+func (s *stream) close(end time.Time) []map[string]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	merged := make(map[string]*partial)
+	for _, bucket := range s.buckets {
+		for group, p := range bucket {
+			m, ok := merged[group]
+			if !ok {
+				m = newPartial()
+				merged[group] = m
+			}
+			m.merge(p)
+		}
+	}
+
+	// the oldest slide leaves the window
+	s.buckets = append(s.buckets[1:], make(map[string]*partial))
+
+	// without groups an empty window is published too, it counts zero
+	if s.cfg.GroupBy == "" && len(merged) == 0 {
+		merged[""] = newPartial()
+	}
+
+	start := end.Add(-s.cfg.Window)
+	messages := make([]map[string]string, 0, len(merged))
+	for group, p := range merged {
+		message := map[string]string{
+			"window_start": start.UTC().Format(time.RFC3339Nano),
+			"window_end":   end.UTC().Format(time.RFC3339Nano),
+		}
+		if s.cfg.GroupBy != "" {
+			message[s.cfg.GroupBy] = group
+		}
+
+		for _, f := range s.functions {
+			switch f.name {
+			case "count":
+				message[f.key()] = strconv.Itoa(p.count)
+			case "sum":
+				message[f.key()] = formatNumber(p.sum[f.column])
+			case "min":
+				if value, ok := p.min[f.column]; ok {
+					message[f.key()] = formatNumber(value)
+				}
+			case "max":
+				if value, ok := p.max[f.column]; ok {
+					message[f.key()] = formatNumber(value)
+				}
+			}
+		}
+
+		messages = append(messages, message)
+	}
+
+	return messages
+}
+
+func (p *partial) merge(other *partial) {
+	p.count += other.count
+	for column, value := range other.sum {
+		p.sum[column] += value
+	}
+	for column, value := range other.min {
+		if current, ok := p.min[column]; !ok || value < current {
+			p.min[column] = value
+		}
+	}
+	for column, value := range other.max {
+		if current, ok := p.max[column]; !ok || value > current {
+			p.max[column] = value
+		}
+	}
+}
+
+func formatNumber(value float64) string {
+	if value == math.Trunc(value) && math.Abs(value) < 1e15 {
+		return strconv.FormatInt(int64(value), 10)
+	}
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
@@ -6,17 +6,23 @@ import (
 	"github.com/golang-jwt/jwt/v4"
 )
 
-// JWT secret for signing and verifying tokens
+// JWT secret for signing and verifying tokens, replaced by auth.secret
 var jwtSecret = []byte("supersecretkey")
 
 type CustomClaims struct {
 	SubID string `json:"user_id"`
+	// Topics, when set, are the only topics and topic patterns the token
+	// can use
+	Topics []string `json:"topics,omitempty"`
 	jwt.RegisteredClaims
 }
 
-func generateJWT(subId string) (string, error) {
+// generateJWT signs a token for a subscriber id, restricted to topics when
+// they are given
+func generateJWT(subId string, topics []string) (string, error) {
 	claims := CustomClaims{
-		SubID: subId,
+		SubID:  subId,
+		Topics: topics,
 		RegisteredClaims: jwt.RegisteredClaims{
 			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour * 24)),
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
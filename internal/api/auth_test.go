@@ -0,0 +1,126 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http/httptest"
+	"realtimer/internal/config"
+	"realtimer/internal/livequery"
+	"realtimer/internal/pubsub"
+	"testing"
+
+	"github.com/fasthttp/websocket"
+)
+
+// newTestServer serves a config with orders routed by tenant on a local port
+func newTestServer(t *testing.T) (*FiberServer, string) {
+	t.Helper()
+
+	var cfg config.DBConfig
+	cfg.Tables = config.Tables{{
+		Name:   "orders",
+		Routes: []string{"{event}:orders.tenant-{tenant_id}"},
+	}}
+
+	manager, err := pubsub.NewSubscriptionManager(cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := New(cfg, manager, livequery.New(cfg, manager))
+	server.RegisterFiberRoutes()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Listener(listener)
+	t.Cleanup(func() { server.Shutdown() })
+
+	return server, listener.Addr().String()
+}
+
+// issue gets a token from /api/auth
+func issue(t *testing.T, server *FiberServer, query string) string {
+	t.Helper()
+
+	response, err := server.Test(httptest.NewRequest("GET", "/api/auth?"+query, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(response.Body)
+
+	var result struct {
+		Token string `json:"token"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil || result.Token == "" {
+		t.Fatalf("/api/auth?%s: %d %s", query, response.StatusCode, body)
+	}
+
+	return result.Token
+}
+
+func TestRestrictedToken(t *testing.T) {
+	server, addr := newTestServer(t)
+	token := issue(t, server, "id=alice&topics=*:orders.tenant-7")
+
+	conn, _, err := websocket.DefaultDialer.Dial(fmt.Sprintf("ws://%s/api/ws?token=%s", addr, token), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	tests := []struct {
+		topic string
+		want  string
+	}{
+		{"insert:orders.tenant-7", pubsub.FrameAck},
+		{"insert:orders.tenant-7:5", pubsub.FrameAck},
+		{"*:orders.*", pubsub.FrameError},
+		{"insert:orders.tenant-8", pubsub.FrameError},
+		{"insert:orders.tenant-8:5", pubsub.FrameError},
+	}
+
+	for i, test := range tests {
+		id := fmt.Sprint(i)
+		request := pubsub.Request{Type: pubsub.FrameSubscribe, Id: id, Topic: test.topic}
+		if err := conn.WriteJSON(request); err != nil {
+			t.Fatal(err)
+		}
+
+		var frame pubsub.Frame
+		if err := conn.ReadJSON(&frame); err != nil {
+			t.Fatal(err)
+		}
+		if frame.Id != id || frame.Type != test.want {
+			t.Errorf("subscribe %s: %+v, want %s", test.topic, frame, test.want)
+		}
+	}
+}
+
+func TestUnrestrictedToken(t *testing.T) {
+	server, addr := newTestServer(t)
+	token := issue(t, server, "id=bob")
+
+	conn, _, err := websocket.DefaultDialer.Dial(fmt.Sprintf("ws://%s/api/ws?token=%s", addr, token), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// tenant topics need a claim
+	request := pubsub.Request{Type: pubsub.FrameSubscribe, Id: "1", Topic: "insert:orders.tenant-7"}
+	if err := conn.WriteJSON(request); err != nil {
+		t.Fatal(err)
+	}
+
+	var frame pubsub.Frame
+	if err := conn.ReadJSON(&frame); err != nil {
+		t.Fatal(err)
+	}
+	if frame.Type != pubsub.FrameError {
+		t.Errorf("subscribe %s without a claim: %+v", request.Topic, frame)
+	}
+}
@@ -1,7 +1,7 @@
 package api
 
 import (
-	"fmt"
+	"realtimer/internal/pubsub"
 	"strings"
 
 	"github.com/gofiber/contrib/websocket"
@@ -12,7 +12,9 @@ func (s *FiberServer) RegisterFiberRoutes() {
 	s.App.Post("/api/db", s.callbackHandler)
 
 	s.App.Get("/api/auth", s.authHandler)
-	s.App.Use("/api/ws", authenticateWS)
+	s.App.Get("/api/stats", authenticate, s.statsHandler)
+	s.App.Get("/api/presence", authenticate, s.presenceHandler)
+	s.App.Use("/api/ws", authenticate)
 	s.App.Get("/api/ws", websocket.New(s.wsHandler))
 }
 
@@ -24,6 +26,14 @@ func (s *FiberServer) callbackHandler(c *fiber.Ctx) error {
 		})
 	}
 
+	// schema events come from the adapter, a callback cannot ask for the
+	// table triggers to be recreated
+	if strings.ToUpper(event) == "SCHEMA" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "schema events are not accepted",
+		})
+	}
+
 	table := c.Queries()["table"]
 	if table == "" {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
@@ -41,9 +51,33 @@ func (s *FiberServer) callbackHandler(c *fiber.Ctx) error {
 		}
 	}
 
-	/// push keyValueEntries to ws connection
-	topic := fmt.Sprintf("%s:%s", strings.ToLower(event), table)
-	go s.pubsubManager.Publish(topic, keyValueEntries)
+	/// push keyValueEntries to ws connection, on the topics the table's
+	/// routes give it
+	go s.pubsubManager.Publish(pubsub.EventTopic(event, table), keyValueEntries)
 
 	return nil
 }
+
+func (s *FiberServer) statsHandler(c *fiber.Ctx) error {
+	topics := c.Locals("topics").([]string)
+	return c.Status(fiber.StatusOK).JSON(s.pubsubManager.Stats(topics))
+}
+
+// presenceHandler lists the subscribers present on the topic given in the
+// topic param, or on every topic, of the topics the token can use
+func (s *FiberServer) presenceHandler(c *fiber.Ctx) error {
+	topics := c.Locals("topics").([]string)
+
+	topic := c.Query("topic")
+	if topic == "" {
+		return c.Status(fiber.StatusOK).JSON(s.pubsubManager.AllPresence(topics))
+	}
+
+	if !s.pubsubManager.Allowed(topics, topic) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "topic not allowed",
+		})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(s.pubsubManager.Presence(topic))
+}
@@ -2,6 +2,7 @@ package api
 
 import (
 	"realtimer/internal/config"
+	"realtimer/internal/livequery"
 	"realtimer/internal/pubsub"
 
 	"github.com/gofiber/fiber/v2"
@@ -11,9 +12,13 @@ type FiberServer struct {
 	*fiber.App
 	cfg           config.DBConfig
 	pubsubManager *pubsub.SubscriptionManager
+	liveQueries   *livequery.Manager
 }
 
-func New(cfg config.DBConfig, pubsub *pubsub.SubscriptionManager) *FiberServer {
+func New(cfg config.DBConfig, pubsub *pubsub.SubscriptionManager, liveQueries *livequery.Manager) *FiberServer {
+	if cfg.Auth.Secret != "" {
+		jwtSecret = []byte(cfg.Auth.Secret)
+	}
 
 	server := &FiberServer{
 		App: fiber.New(fiber.Config{
@@ -22,6 +27,7 @@ func New(cfg config.DBConfig, pubsub *pubsub.SubscriptionManager) *FiberServer {
 		}),
 		cfg:           cfg,
 		pubsubManager: pubsub,
+		liveQueries:   liveQueries,
 	}
 
 	return server
@@ -1,16 +1,21 @@
 package api
 
 import (
+	"encoding/json"
 	"fmt"
+	"log"
+	"realtimer/internal/livequery"
 	"realtimer/internal/pubsub"
+	"strings"
+	"time"
 
 	"github.com/gofiber/contrib/websocket"
 	"github.com/gofiber/fiber/v2"
 	"github.com/golang-jwt/jwt/v4"
 )
 
-// Middleware to authenticate WebSocket connection using JWT
-func authenticateWS(c *fiber.Ctx) error {
+// Middleware to authenticate WebSocket connections and API requests using JWT
+func authenticate(c *fiber.Ctx) error {
 	tokenString := c.Query("token") // or get token from headers
 
 	if tokenString == "" {
@@ -39,6 +44,7 @@ func authenticateWS(c *fiber.Ctx) error {
 
 	// Store userID in context locals for later use
 	c.Locals("subId", claims.SubID)
+	c.Locals("topics", claims.Topics)
 
 	return c.Next()
 }
@@ -51,7 +57,13 @@ func (s *FiberServer) authHandler(c *fiber.Ctx) error {
 		})
 	}
 
-	token, err := generateJWT(id)
+	// topics=a,b issues a token that can only use those topics
+	var topics []string
+	if param := c.Query("topics"); param != "" {
+		topics = strings.Split(param, ",")
+	}
+
+	token, err := generateJWT(id, topics)
 	if err != nil {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
 			"error": "event param does not exist",
@@ -63,39 +75,231 @@ func (s *FiberServer) authHandler(c *fiber.Ctx) error {
 	})
 }
 
-// WebSocket handler to handle event subscriptions
+// WebSocket handler to handle event subscriptions. A connection opened with
+// the event and table query parameters is subscribed to that topic right
+// away, any connection can add and drop topics with protocol requests.
 func (s *FiberServer) wsHandler(c *websocket.Conn) {
 	defer c.Close()
 
-	event := c.Query("event")
-	if event == "" {
-		fmt.Println("event param does not exist")
-		return
-	}
+	subId := c.Locals("subId").(string)
+	topics := c.Locals("topics").([]string)
 
+	subscriber := s.pubsubManager.AddSubscriber(c, subId, topics)
+	defer s.pubsubManager.RemoveSubscriber(subscriber)
+	defer s.liveQueries.RemoveSubscriber(subscriber)
+
+	event := c.Query("event")
 	table := c.Query("table")
-	if table == "" {
-		fmt.Println("table param does not exist")
-		return
-	}
+	if event != "" || table != "" {
+		if event == "" {
+			fmt.Println("event param does not exist")
+			return
+		}
 
-	topic := fmt.Sprintf("%s:%s", event, table)
-	subId := c.Locals("subId").(string)
+		if table == "" {
+			fmt.Println("table param does not exist")
+			return
+		}
 
-	subscriber := pubsub.Subscriber{
-		Conn: c,
-		Id:   subId,
-	}
+		topic := fmt.Sprintf("%s:%s", event, table)
+		if !s.pubsubManager.Allowed(topics, topic) {
+			fmt.Println("topic not allowed")
+			return
+		}
 
-	s.pubsubManager.Subscribe(topic, subscriber)
-	defer s.pubsubManager.Unsubscribe(topic, subscriber)
+		s.pubsubManager.Subscribe(&pubsub.Subscription{
+			Topic:      topic,
+			Subscriber: subscriber,
+			Raw:        true,
+		})
+	}
 
 	fmt.Printf("subsriber %s connected\n", subId)
 	for {
 		// Read message from client
-		_, _, err := c.ReadMessage()
+		_, message, err := c.ReadMessage()
 		if err != nil {
 			break
 		}
+
+		s.handleRequest(subscriber, message)
 	}
 }
+
+// handleRequest runs a single protocol request and answers it
+func (s *FiberServer) handleRequest(subscriber *pubsub.Subscriber, message []byte) {
+	var request pubsub.Request
+	if err := json.Unmarshal(message, &request); err != nil {
+		s.replyError(subscriber, request, "invalid request")
+		return
+	}
+
+	// the token's claims decide which topics a connection can use
+	switch request.Type {
+	case pubsub.FrameSubscribe, pubsub.FramePublish, pubsub.FramePresence:
+		if !s.pubsubManager.Allowed(subscriber.Claims, request.Topic) {
+			s.replyError(subscriber, request, "topic not allowed")
+			return
+		}
+	}
+
+	if livequery.IsQuery(request.Topic) {
+		s.handleQueryRequest(subscriber, request)
+		return
+	}
+
+	// row topics are checked, and a key turned into one
+	topic, err := s.pubsubManager.ResolveTopic(request.Topic, request.Key)
+	if err != nil {
+		s.replyError(subscriber, request, err.Error())
+		return
+	}
+	request.Topic = topic
+
+	switch request.Type {
+	case pubsub.FrameSubscribe:
+		if request.Topic == "" {
+			s.replyError(subscriber, request, "topic is missing")
+			return
+		}
+
+		if request.Filter != nil {
+			if err := request.Filter.Compile(); err != nil {
+				s.replyError(subscriber, request, fmt.Sprintf("invalid filter: %v", err))
+				return
+			}
+		}
+
+		if request.Durable && subscriber.Id == "" {
+			s.replyError(subscriber, request, "durable subscriptions need a token with a user_id")
+			return
+		}
+
+		if err := pubsub.ValidatePresence(request.Meta); err != nil {
+			s.replyError(subscriber, request, err.Error())
+			return
+		}
+
+		if request.Durable && request.Group != "" {
+			s.replyError(subscriber, request, "durable subscriptions cannot join a group")
+			return
+		}
+
+		var coalesce time.Duration
+		if request.Coalesce != "" {
+			coalesce, err = time.ParseDuration(request.Coalesce)
+			if err != nil || coalesce <= 0 || coalesce > pubsub.MaxCoalesceWindow {
+				s.replyError(subscriber, request, pubsub.ErrCoalesceWindow.Error())
+				return
+			}
+			if request.Durable || request.Group != "" {
+				s.replyError(subscriber, request, "coalescing subscriptions cannot be durable or join a group")
+				return
+			}
+		}
+
+		subscription := &pubsub.Subscription{
+			Topic:      request.Topic,
+			Subscriber: subscriber,
+			Filter:     request.Filter,
+			Group:      request.Group,
+			Presence:   request.Presence,
+			Meta:       request.Meta,
+			Coalesce:   coalesce,
+			Fields:     request.Fields,
+		}
+
+		// the ack goes first, replayed events follow it
+		s.reply(subscriber, pubsub.Frame{Type: pubsub.FrameAck, Id: request.Id, Topic: request.Topic})
+		if request.Durable {
+			s.pubsubManager.SubscribeDurable(subscription, request.ResumeFrom, request.Id)
+		} else if request.ResumeFrom != nil {
+			s.pubsubManager.SubscribeFrom(subscription, *request.ResumeFrom, request.Id)
+		} else {
+			s.pubsubManager.Subscribe(subscription)
+		}
+
+	case pubsub.FrameUnsubscribe:
+		if !s.pubsubManager.Unsubscribe(request.Topic, subscriber) {
+			s.replyError(subscriber, request, "not subscribed")
+			return
+		}
+
+		s.reply(subscriber, pubsub.Frame{Type: pubsub.FrameAck, Id: request.Id, Topic: request.Topic})
+
+	case pubsub.FrameAck:
+		if err := s.pubsubManager.Ack(subscriber, request.Topic, request.Seq); err != nil {
+			s.replyError(subscriber, request, err.Error())
+			return
+		}
+
+		s.reply(subscriber, pubsub.Frame{Type: pubsub.FrameAck, Id: request.Id, Topic: request.Topic, Seq: request.Seq})
+
+	case pubsub.FramePublish:
+		if err := s.pubsubManager.Broadcast(subscriber, request.Topic, request.Data); err != nil {
+			s.replyError(subscriber, request, err.Error())
+			return
+		}
+
+		s.reply(subscriber, pubsub.Frame{Type: pubsub.FrameAck, Id: request.Id, Topic: request.Topic})
+
+	case pubsub.FramePresence:
+		if err := s.pubsubManager.SetPresence(subscriber, request.Topic, request.Meta); err != nil {
+			s.replyError(subscriber, request, err.Error())
+			return
+		}
+
+		s.reply(subscriber, pubsub.Frame{Type: pubsub.FrameAck, Id: request.Id, Topic: request.Topic})
+
+	case pubsub.FramePing:
+		s.reply(subscriber, pubsub.Frame{Type: pubsub.FramePong, Id: request.Id})
+
+	default:
+		s.replyError(subscriber, request, fmt.Sprintf("unknown request type %q", request.Type))
+	}
+}
+
+// handleQueryRequest subscribes to and unsubscribes from live queries
+func (s *FiberServer) handleQueryRequest(subscriber *pubsub.Subscriber, request pubsub.Request) {
+	topic, err := s.liveQueries.ResolveTopic(request.Topic, request.Params)
+	if err != nil {
+		s.replyError(subscriber, request, err.Error())
+		return
+	}
+	request.Topic = topic
+
+	switch request.Type {
+	case pubsub.FrameSubscribe:
+		// the result follows the ack
+		s.reply(subscriber, pubsub.Frame{Type: pubsub.FrameAck, Id: request.Id, Topic: request.Topic})
+		if err := s.liveQueries.Subscribe(subscriber, request.Topic, request.Id); err != nil {
+			s.replyError(subscriber, request, err.Error())
+		}
+
+	case pubsub.FrameUnsubscribe:
+		if err := s.liveQueries.Unsubscribe(subscriber, request.Topic); err != nil {
+			s.replyError(subscriber, request, err.Error())
+			return
+		}
+
+		s.reply(subscriber, pubsub.Frame{Type: pubsub.FrameAck, Id: request.Id, Topic: request.Topic})
+
+	default:
+		s.replyError(subscriber, request, fmt.Sprintf("%s requests are not supported on live queries", request.Type))
+	}
+}
+
+func (s *FiberServer) reply(subscriber *pubsub.Subscriber, frame pubsub.Frame) {
+	if err := subscriber.SendFrame(frame); err != nil {
+		log.Printf("error replying to subscriber %s: %v", subscriber.Id, err)
+	}
+}
+
+func (s *FiberServer) replyError(subscriber *pubsub.Subscriber, request pubsub.Request, message string) {
+	s.reply(subscriber, pubsub.Frame{
+		Type:  pubsub.FrameError,
+		Id:    request.Id,
+		Topic: request.Topic,
+		Error: message,
+	})
+}
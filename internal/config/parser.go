@@ -2,17 +2,124 @@ package config
 
 import (
 	"os"
+	"time"
 
 	yaml "gopkg.in/yaml.v3"
 )
 
 type Table struct {
-	Name       string   `yaml:"name"`
-	Operations []string `yaml:"operations"`
+	Name       string    `yaml:"name"`
+	Operations []string  `yaml:"operations"`
+	Schedule   *Schedule `yaml:"schedule"`
+	// Topic is the kafka topic of a debezium source, defaults to
+	// <kafka.topic_prefix>.<name>
+	Topic string `yaml:"topic"`
+	// PrimaryKey are the columns identifying a row, default id
+	PrimaryKey []string `yaml:"primary_key"`
+	// Coalesce holds back the changes of each row for this window and only
+	// publishes the latest version
+	Coalesce time.Duration `yaml:"coalesce"`
+	// Enrich embeds columns of related rows in the events
+	Enrich []Enrichment `yaml:"enrich"`
+	// Routes are the topics the events are published on instead of
+	// <event>:<table>, templates of {event}, {table} and {<field>}
+	Routes []string `yaml:"routes"`
+	// Public is the name clients subscribe to instead of Name, Aliases
+	// are more names the events are published on, e.g. categories.v1
+	Public  string   `yaml:"public"`
+	Aliases []string `yaml:"aliases"`
+	// Transform are the steps the events go through before they are
+	// published
+	Transform []Transform `yaml:"transform"`
+}
+
+// Transform is a step changing the events of a table, its parts run in the
+// order rename, set, remove, drop_if. Set maps fields to the expressions
+// computing them, an event for which DropIf is true is not published.
+type Transform struct {
+	Rename map[string]string `yaml:"rename"`
+	Set    map[string]string `yaml:"set"`
+	Remove []string          `yaml:"remove"`
+	DropIf string            `yaml:"drop_if"`
+}
+
+// Enrichment looks up the row of Table whose Key column (default id) equals
+// Column of the event, its Columns are added to the event as <as>.<column>,
+// As defaults to the table name. Looked up rows are cached for TTL, default
+// 10s.
+type Enrichment struct {
+	Column  string        `yaml:"column"`
+	Table   string        `yaml:"table"`
+	Key     string        `yaml:"key"`
+	Columns []string      `yaml:"columns"`
+	As      string        `yaml:"as"`
+	TTL     time.Duration `yaml:"ttl"`
+}
+
+// Schedule turns a timestamp column into time-based events: a "due" event
+// is published for every row once the time stored in Column is reached.
+type Schedule struct {
+	Column       string        `yaml:"column"`
+	PollInterval time.Duration `yaml:"poll_interval"`
+	// Lag is how far back every poll looks again for rows committed late,
+	// default 1m
+	Lag time.Duration `yaml:"lag"`
 }
 
 type Tables []Table
 
+// LiveQuery is a query clients can subscribe to, its result is sent again as
+// a diff whenever one of Tables changes
+type LiveQuery struct {
+	Name string `yaml:"name"`
+	// SQL uses the placeholders of the database, filled with the Params
+	// given by the client in this order
+	SQL    string   `yaml:"sql"`
+	Params []string `yaml:"params"`
+	Tables []string `yaml:"tables"`
+	// Key are the columns identifying a result row, default id
+	Key []string `yaml:"key"`
+}
+
+// Aggregate is a derived topic, aggregate:<name>, publishing aggregates of
+// the events of Topic at the close of every window
+type Aggregate struct {
+	Name  string `yaml:"name"`
+	Topic string `yaml:"topic"`
+	// Window is the length of a window, a new one starts every Slide,
+	// default Window for tumbling windows
+	Window time.Duration `yaml:"window"`
+	Slide  time.Duration `yaml:"slide"`
+	// Functions are count, sum(<column>), min(<column>) and max(<column>)
+	Functions []string `yaml:"functions"`
+	GroupBy   string   `yaml:"group_by"`
+}
+
+// Plugin is a WebAssembly module the events go through before they are
+// published, internal/plugin describes what it has to export
+type Plugin struct {
+	Name string `yaml:"name"`
+	Path string `yaml:"path"`
+	// Topics are the topics or topic patterns of the events the plugin
+	// gets, default every event
+	Topics []string `yaml:"topics"`
+	// Timeout is the longest the plugin can take for an event, default
+	// 100ms
+	Timeout time.Duration `yaml:"timeout"`
+	// MaxMemory is the memory the plugin can use in MB, default 64
+	MaxMemory int `yaml:"max_memory"`
+	// OnError is what happens to an event the plugin fails on, drop
+	// (default) or pass to publish it unchanged
+	OnError string `yaml:"on_error"`
+}
+
+// Retention limits how much of a topic's history the event log keeps, zero
+// values keep everything
+type Retention struct {
+	MaxAge   time.Duration `yaml:"max_age"`
+	MaxBytes int64         `yaml:"max_bytes"`
+}
+
 type DBConfig struct {
 	Tables   Tables `yaml:"tables"`
 	Database struct {
@@ -23,7 +130,49 @@ type DBConfig struct {
 		Port     int    `yaml:"port"`
 		Name     string `yaml:"name"`
 		Os       string `yaml:"os"`
+		// SchemaEvents installs event triggers that publish schema:<table>
+		// events on DDL and recreate the table triggers (postgres only)
+		SchemaEvents bool `yaml:"schema_events"`
+		// PollInterval is how often the sqlite outbox table is read
+		PollInterval time.Duration `yaml:"poll_interval"`
 	} `yaml:"database"`
+	Kafka struct {
+		Brokers     []string `yaml:"brokers"`
+		GroupId     string   `yaml:"group_id"`
+		TopicPrefix string   `yaml:"topic_prefix"`
+	} `yaml:"kafka"`
+	Pubsub struct {
+		// QueueSize is the number of messages buffered per connection
+		QueueSize int `yaml:"queue_size"`
+		// Overflow is applied when a connection's queue is full: drop_oldest
+		// (default), drop_newest or disconnect
+		Overflow string `yaml:"overflow"`
+		// ReplaySize is the number of recent events kept per topic for
+		// resuming clients, default 100, negative disables replay
+		ReplaySize int `yaml:"replay_size"`
+		// AckTimeout is how long an event sent to a durable subscription
+		// waits for its ack before it is sent again, default 30s
+		AckTimeout time.Duration `yaml:"ack_timeout"`
+		// MaxUnacked disconnects a durable subscriber with more events
+		// waiting for an ack, default 1000
+		MaxUnacked int `yaml:"max_unacked"`
+		// BroadcastRate is the number of messages a connection can publish
+		// to broadcast channels per second, default 20, with bursts of up to
+		// BroadcastBurst messages, default the rate
+		BroadcastRate  float64 `yaml:"broadcast_rate"`
+		BroadcastBurst int     `yaml:"broadcast_burst"`
+	} `yaml:"pubsub"`
+	EventLog struct {
+		// Dir enables the on-disk event log, empty keeps history in memory only
+		Dir         string `yaml:"dir"`
+		SegmentSize int64  `yaml:"segment_size"`
+		// Fsync syncs every event to disk instead of relying on the OS to
+		// flush writes, which only protects against process crashes
+		Fsync     bool `yaml:"fsync"`
+		Retention `yaml:",inline"`
+		// Topics overrides the retention of single topics
+		Topics map[string]Retention `yaml:"topics"`
+	} `yaml:"event_log"`
 	Servers struct {
 		WsPort      int    `yaml:"ws_port"`
 		HTTPPort    int    `yaml:"http_port"`
@@ -31,6 +180,14 @@ type DBConfig struct {
 		HttpBaseUrl string `yaml:"http_base_url"`
 		IsRemote    bool   `yaml:"is_remote"`
 	} `yaml:"servers"`
+	Auth struct {
+		// Secret signs and verifies the tokens, tokens with a topics claim
+		// can be signed with it outside the service
+		Secret string `yaml:"secret"`
+	} `yaml:"auth"`
+	LiveQueries []LiveQuery `yaml:"live_queries"`
+	Aggregates  []Aggregate `yaml:"aggregates"`
+	Plugins     []Plugin    `yaml:"plugins"`
 }
 
 var cfg DBConfig
@@ -0,0 +1,135 @@
+package enrich
+
+import (
+	"log"
+	"maps"
+	"realtimer/internal/adapters"
+	"realtimer/internal/config"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultTTL   = 10 * time.Second
+	maxCacheSize = 10000
+)
+
+// Enricher adds the columns of related rows to the events of the tables
+// that declare lookups
+type Enricher struct {
+	cfg     config.DBConfig
+	lookups map[string][]config.Enrichment // by table
+
+	mu    sync.Mutex
+	cache map[cacheKey]cacheEntry
+}
+
+type cacheKey struct {
+	table   string
+	key     string
+	columns string
+	value   string
+}
+
+type cacheEntry struct {
+	row     map[string]string // nil when there is no such row
+	expires time.Time
+}
+
+// New returns an enricher for the lookups of the configured tables, nil when
+// no table has any
+func New(cfg config.DBConfig) *Enricher {
+	lookups := make(map[string][]config.Enrichment)
+	for _, table := range cfg.Tables {
+		for _, lookup := range table.Enrich {
+			if lookup.Key == "" {
+				lookup.Key = "id"
+			}
+			if lookup.As == "" {
+				lookup.As = lookup.Table
+			}
+			if lookup.TTL <= 0 {
+				lookup.TTL = defaultTTL
+			}
+			lookups[table.Name] = append(lookups[table.Name], lookup)
+		}
+	}
+
+	if len(lookups) == 0 {
+		return nil
+	}
+
+	return &Enricher{
+		cfg:     cfg,
+		lookups: lookups,
+		cache:   make(map[cacheKey]cacheEntry),
+	}
+}
+
+// Enrich is the pubsub stage embedding the related rows in an event, the
+// event is published without them when a lookup fails
+func (e *Enricher) Enrich(topic string, message map[string]string) map[string]string {
+	_, table, _ := strings.Cut(topic, ":")
+	lookups, ok := e.lookups[table]
+	if !ok {
+		return message
+	}
+
+	// the message may be shared with the caller
+	enriched := maps.Clone(message)
+	for _, lookup := range lookups {
+		value, ok := message[lookup.Column]
+		if !ok || value == "NULL" {
+			continue
+		}
+
+		row, err := e.lookup(lookup, value)
+		if err != nil {
+			log.Printf("error looking up %s %s for %s: %v", lookup.Table, value, topic, err)
+			continue
+		}
+
+		for _, column := range lookup.Columns {
+			if v, ok := row[column]; ok {
+				enriched[lookup.As+"."+column] = v
+			}
+		}
+	}
+
+	return enriched
+}
+
+func (e *Enricher) lookup(lookup config.Enrichment, value string) (map[string]string, error) {
+	key := cacheKey{table: lookup.Table, key: lookup.Key, columns: strings.Join(lookup.Columns, ","), value: value}
+	now := time.Now()
+
+	e.mu.Lock()
+	entry, ok := e.cache[key]
+	e.mu.Unlock()
+	if ok && now.Before(entry.expires) {
+		return entry.row, nil
+	}
+
+	row, err := adapters.Lookup(e.cfg, lookup.Table, lookup.Key, value, lookup.Columns)
+	if err != nil {
+		return nil, err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if len(e.cache) >= maxCacheSize {
+		for k, entry := range e.cache {
+			if now.After(entry.expires) {
+				delete(e.cache, k)
+			}
+		}
+		if len(e.cache) >= maxCacheSize {
+			e.cache = make(map[cacheKey]cacheEntry)
+		}
+	}
+	e.cache[key] = cacheEntry{row: row, expires: now.Add(lookup.TTL)}
+
+	return row, nil
+}
@@ -0,0 +1,67 @@
+package eventlog
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+const cursorsFile = "cursors.json"
+
+// Cursors maps a subscriber id to the last acknowledged sequence id of each
+// of its durable subscriptions, by topic
+type Cursors map[string]map[string]uint64
+
+// LoadCursors reads the positions of the durable subscriptions stored with
+// the log
+func (l *Log) LoadCursors() (Cursors, error) {
+	cursors := make(Cursors)
+
+	data, err := os.ReadFile(filepath.Join(l.dir, cursorsFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return cursors, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, &cursors); err != nil {
+		return nil, err
+	}
+
+	return cursors, nil
+}
+
+// SaveCursors replaces the stored positions of the durable subscriptions,
+// the file is written next to the old one and renamed over it so a crash
+// never leaves half of it behind
+func (l *Log) SaveCursors(cursors Cursors) error {
+	data, err := json.Marshal(cursors)
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(l.dir, cursorsFile)
+	f, err := os.CreateTemp(l.dir, cursorsFile+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if l.fsync {
+		if err := f.Sync(); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+}
@@ -0,0 +1,522 @@
+package eventlog
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"realtimer/internal/config"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultSegmentSize = 4 << 20
+	retentionInterval  = time.Minute
+	segmentExt         = ".log"
+	evictedFile        = "evicted"
+	topicsFile         = "topics"
+)
+
+// Event is a published event as stored in the log
+type Event struct {
+	Seq   uint64    `json:"seq"`
+	Time  time.Time `json:"time"`
+	Topic string    `json:"topic"`
+	// Topics are the other topics the event was published on, it is stored
+	// once in the log of Topic
+	Topics []string          `json:"topics,omitempty"`
+	Data   map[string]string `json:"data"`
+}
+
+// Log is an append-only event log on local disk. Every topic has its own
+// directory of segment files, named after the sequence id of their first
+// event and holding one JSON encoded event per line. An event published on
+// several topics is stored with the first one, whose directory lists the
+// others. Segments are removed
+// once they are older than the retention age or the topic is over its size
+// budget, the sequence id of the last removed event is kept so a replay
+// knows it cannot be complete.
+type Log struct {
+	dir         string
+	segmentSize int64
+	fsync       bool
+	retention   config.Retention
+	overrides   map[string]config.Retention
+
+	mu      sync.Mutex
+	topics  map[string]*topicLog
+	lastSeq uint64
+}
+
+type topicLog struct {
+	topic    string
+	dir      string
+	segments []*segment // oldest first, the last one is written to
+	active   *os.File
+	evicted  uint64
+	// others are the other topics of its events, kept in the topics file
+	others map[string]struct{}
+}
+
+type segment struct {
+	first   uint64
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+// Open loads the log in the configured directory, it returns nil when no
+// directory is configured
+func Open(cfg config.DBConfig) (*Log, error) {
+	if cfg.EventLog.Dir == "" {
+		return nil, nil
+	}
+
+	if err := os.MkdirAll(cfg.EventLog.Dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create event log directory: %w", err)
+	}
+
+	segmentSize := cfg.EventLog.SegmentSize
+	if segmentSize <= 0 {
+		segmentSize = defaultSegmentSize
+	}
+
+	l := &Log{
+		dir:         cfg.EventLog.Dir,
+		segmentSize: segmentSize,
+		fsync:       cfg.EventLog.Fsync,
+		retention:   cfg.EventLog.Retention,
+		overrides:   cfg.EventLog.Topics,
+		topics:      make(map[string]*topicLog),
+	}
+
+	entries, err := os.ReadDir(l.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+
+		topic, err := url.QueryUnescape(entry.Name())
+		if err != nil {
+			continue
+		}
+
+		t, err := l.loadTopic(topic, filepath.Join(l.dir, entry.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to load event log of topic %s: %w", topic, err)
+		}
+		l.topics[topic] = t
+	}
+
+	l.mu.Lock()
+	l.enforceRetention()
+	l.mu.Unlock()
+
+	go l.retentionLoop()
+
+	return l, nil
+}
+
+func (l *Log) loadTopic(topic string, dir string) (*topicLog, error) {
+	t := &topicLog{topic: topic, dir: dir, others: make(map[string]struct{})}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		if name == evictedFile {
+			data, err := os.ReadFile(filepath.Join(dir, name))
+			if err == nil {
+				t.evicted, _ = strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+			}
+			continue
+		}
+		if name == topicsFile {
+			data, err := os.ReadFile(filepath.Join(dir, name))
+			if err != nil {
+				return nil, err
+			}
+			for _, line := range strings.Fields(string(data)) {
+				if other, err := url.QueryUnescape(line); err == nil {
+					t.others[other] = struct{}{}
+				}
+			}
+			continue
+		}
+
+		if !strings.HasSuffix(name, segmentExt) {
+			continue
+		}
+
+		first, err := strconv.ParseUint(strings.TrimSuffix(name, segmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+
+		t.segments = append(t.segments, &segment{
+			first:   first,
+			path:    filepath.Join(dir, name),
+			size:    info.Size(),
+			modTime: info.ModTime(),
+		})
+	}
+
+	sort.Slice(t.segments, func(i, j int) bool { return t.segments[i].first < t.segments[j].first })
+
+	if len(t.segments) > 0 {
+		// a crash can leave half a line at the end of the last segment
+		last, err := repairSegment(t.segments[len(t.segments)-1])
+		if err != nil {
+			return nil, err
+		}
+		if last > l.lastSeq {
+			l.lastSeq = last
+		}
+	}
+	if t.evicted > l.lastSeq {
+		l.lastSeq = t.evicted
+	}
+
+	return t, nil
+}
+
+// repairSegment truncates the segment after its last complete event and
+// returns the sequence id of that event
+func repairSegment(seg *segment) (uint64, error) {
+	data, err := os.ReadFile(seg.path)
+	if err != nil {
+		return 0, err
+	}
+
+	var last uint64
+	valid := 0
+	for offset := 0; offset < len(data); {
+		end := bytes.IndexByte(data[offset:], '\n')
+		if end < 0 {
+			break
+		}
+
+		var event Event
+		if err := json.Unmarshal(data[offset:offset+end], &event); err != nil {
+			break
+		}
+
+		last = event.Seq
+		offset += end + 1
+		valid = offset
+	}
+
+	if valid < len(data) {
+		if err := os.Truncate(seg.path, int64(valid)); err != nil {
+			return 0, err
+		}
+		seg.size = int64(valid)
+	}
+
+	return last, nil
+}
+
+// LastSeq returns the sequence id of the last event ever appended
+func (l *Log) LastSeq() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.lastSeq
+}
+
+// Append writes an event to the log of its topic, sequence ids have to be
+// increasing
+func (l *Log) Append(event Event) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	t, ok := l.topics[event.Topic]
+	if !ok {
+		dir := filepath.Join(l.dir, url.QueryEscape(event.Topic))
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return err
+		}
+		t = &topicLog{topic: event.Topic, dir: dir, others: make(map[string]struct{})}
+		l.topics[event.Topic] = t
+	}
+
+	if err := t.addOthers(event.Topics); err != nil {
+		return err
+	}
+
+	var seg *segment
+	if len(t.segments) > 0 {
+		seg = t.segments[len(t.segments)-1]
+	}
+
+	if seg == nil || seg.size >= l.segmentSize {
+		if t.active != nil {
+			t.active.Sync()
+			t.active.Close()
+			t.active = nil
+		}
+
+		seg = &segment{
+			first: event.Seq,
+			path:  filepath.Join(t.dir, fmt.Sprintf("%020d%s", event.Seq, segmentExt)),
+		}
+		t.segments = append(t.segments, seg)
+	}
+
+	if t.active == nil {
+		t.active, err = os.OpenFile(seg.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return err
+		}
+	}
+
+	if _, err := t.active.Write(data); err != nil {
+		return err
+	}
+	if l.fsync {
+		if err := t.active.Sync(); err != nil {
+			return err
+		}
+	}
+
+	seg.size += int64(len(data))
+	seg.modTime = event.Time
+	if event.Seq > l.lastSeq {
+		l.lastSeq = event.Seq
+	}
+
+	return nil
+}
+
+// Since returns the stored events of every topic accepted by match published
+// after the given sequence id, in order, events published on several topics
+// once. gap is true when retention already removed some of them. The
+// segments are read without blocking appends.
+func (l *Log) Since(match func(topic string) bool, after uint64) (events []Event, gap bool, err error) {
+	var segments []segment
+	l.mu.Lock()
+	for _, t := range l.topics {
+		if !t.matches(match) {
+			continue
+		}
+		if t.evicted > after {
+			l.mu.Unlock()
+			return nil, true, nil
+		}
+
+		for i, seg := range t.segments {
+			// skip segments that end before the requested position
+			if i+1 < len(t.segments) && t.segments[i+1].first <= after+1 {
+				continue
+			}
+			segments = append(segments, *seg)
+		}
+	}
+	l.mu.Unlock()
+
+	for _, seg := range segments {
+		events, err = readSegment(seg, after, match, events)
+		if errors.Is(err, fs.ErrNotExist) {
+			// removed by retention in the meantime
+			return nil, true, nil
+		}
+		if err != nil {
+			return nil, false, err
+		}
+	}
+
+	sort.Slice(events, func(i, j int) bool { return events[i].Seq < events[j].Seq })
+	return events, false, nil
+}
+
+// matches reports whether match accepts the topic or one of the other
+// topics of its events
+func (t *topicLog) matches(match func(topic string) bool) bool {
+	if match(t.topic) {
+		return true
+	}
+
+	for other := range t.others {
+		if match(other) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// addOthers remembers the other topics of an event, l.mu has to be held
+func (t *topicLog) addOthers(topics []string) error {
+	var added []string
+	for _, topic := range topics {
+		if _, ok := t.others[topic]; !ok {
+			added = append(added, url.QueryEscape(topic)+"\n")
+		}
+	}
+	if len(added) == 0 {
+		return nil
+	}
+
+	f, err := os.OpenFile(filepath.Join(t.dir, topicsFile), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err := f.WriteString(strings.Join(added, "")); err != nil {
+		return err
+	}
+
+	for _, topic := range topics {
+		t.others[topic] = struct{}{}
+	}
+	return nil
+}
+
+// readSegment reads the events of a segment up to the size it had when it
+// was looked up
+func readSegment(seg segment, after uint64, match func(topic string) bool, events []Event) ([]Event, error) {
+	f, err := os.Open(seg.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	reader := bufio.NewReader(io.LimitReader(f, seg.size))
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			return events, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		var event Event
+		if err := json.Unmarshal(line, &event); err != nil {
+			return nil, fmt.Errorf("corrupt event in %s: %w", seg.path, err)
+		}
+		if event.Seq > after && (match(event.Topic) || slices.ContainsFunc(event.Topics, match)) {
+			events = append(events, event)
+		}
+	}
+}
+
+func (l *Log) retentionLoop() {
+	ticker := time.NewTicker(retentionInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		l.mu.Lock()
+		l.enforceRetention()
+		l.mu.Unlock()
+	}
+}
+
+// enforceRetention removes the segments that are too old or over the size
+// budget of their topic, l.mu has to be held
+func (l *Log) enforceRetention() {
+	now := time.Now()
+
+	for topic, t := range l.topics {
+		retention := l.retention
+		if override, ok := l.overrides[topic]; ok {
+			retention = override
+		}
+
+		var total int64
+		for _, seg := range t.segments {
+			total += seg.size
+		}
+
+		for len(t.segments) > 0 {
+			seg := t.segments[0]
+			expired := retention.MaxAge > 0 && now.Sub(seg.modTime) > retention.MaxAge
+			oversized := retention.MaxBytes > 0 && total > retention.MaxBytes && len(t.segments) > 1
+			if !expired && !oversized {
+				break
+			}
+
+			if err := t.removeOldest(); err != nil {
+				log.Printf("error removing event log segment %s: %v", seg.path, err)
+				break
+			}
+			total -= seg.size
+		}
+	}
+}
+
+func (t *topicLog) removeOldest() error {
+	seg := t.segments[0]
+
+	if len(t.segments) == 1 && t.active != nil {
+		t.active.Close()
+		t.active = nil
+	}
+
+	last, err := repairSegment(seg)
+	if err != nil {
+		return err
+	}
+
+	if last > t.evicted {
+		t.evicted = last
+		err := os.WriteFile(filepath.Join(t.dir, evictedFile), []byte(strconv.FormatUint(last, 10)), 0o644)
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := os.Remove(seg.path); err != nil {
+		return err
+	}
+
+	t.segments = t.segments[1:]
+	return nil
+}
+
+// Close flushes and closes the segments being written
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, t := range l.topics {
+		if t.active != nil {
+			t.active.Sync()
+			t.active.Close()
+			t.active = nil
+		}
+	}
+
+	return nil
+}
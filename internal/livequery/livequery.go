@@ -0,0 +1,349 @@
+package livequery
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"net/url"
+	"realtimer/internal/adapters"
+	"realtimer/internal/config"
+	"realtimer/internal/pubsub"
+	"strings"
+	"sync"
+)
+
+var (
+	ErrUnknownQuery = errors.New("unknown live query")
+	ErrNotWatching  = errors.New("not subscribed")
+)
+
+var defaultKey = []string{"id"}
+
+// Manager runs the live queries clients subscribe to. Subscribers of the same
+// query with the same parameters share one instance, which runs the query
+// again after every event on a table it reads and sends them what changed.
+type Manager struct {
+	queries map[string]config.LiveQuery
+	tables  map[string][]string // table to the names of the queries reading it
+
+	mu        sync.Mutex
+	instances map[string]*instance // by topic
+}
+
+// instance is a live query with its parameters filled in
+type instance struct {
+	topic string
+	query config.LiveQuery
+	args  []interface{}
+
+	mu          sync.Mutex
+	subscribers map[*pubsub.Subscriber]string // to the id of their subscribe request
+	rows        map[string]map[string]string  // last result by row key
+	last        []map[string]string           // last result in query order
+	loaded      bool
+	stale       chan struct{}
+}
+
+func New(cfg config.DBConfig, pubsubManager *pubsub.SubscriptionManager) *Manager {
+	m := &Manager{
+		queries:   make(map[string]config.LiveQuery),
+		tables:    make(map[string][]string),
+		instances: make(map[string]*instance),
+	}
+
+	for _, query := range cfg.LiveQueries {
+		m.queries[query.Name] = query
+		for _, table := range query.Tables {
+			m.tables[table] = append(m.tables[table], query.Name)
+		}
+	}
+
+	if len(m.queries) > 0 {
+		pubsubManager.Watch(m.changed)
+	}
+
+	return m
+}
+
+// IsQuery reports whether a topic is a live query topic
+func IsQuery(topic string) bool {
+	return strings.HasPrefix(topic, pubsub.QueryPrefix)
+}
+
+// ResolveTopic checks a live query topic, params given by name are added to
+// it in the order of the query's parameters
+func (m *Manager) ResolveTopic(topic string, params map[string]string) (string, error) {
+	name, values, _ := strings.Cut(strings.TrimPrefix(topic, pubsub.QueryPrefix), ":")
+	query, ok := m.queries[name]
+	if !ok {
+		return "", fmt.Errorf("%w %s", ErrUnknownQuery, name)
+	}
+
+	if len(params) > 0 {
+		if values != "" {
+			return "", errors.New("parameters are given twice")
+		}
+
+		escaped := make([]string, len(query.Params))
+		for i, param := range query.Params {
+			value, ok := params[param]
+			if !ok {
+				return "", fmt.Errorf("parameter %s is missing", param)
+			}
+			escaped[i] = url.QueryEscape(value)
+		}
+		if len(params) != len(query.Params) {
+			return "", fmt.Errorf("%s has parameters %s", name, strings.Join(query.Params, ", "))
+		}
+
+		topic = pubsub.QueryPrefix + name + ":" + strings.Join(escaped, ",")
+		values = strings.Join(escaped, ",")
+	}
+
+	if _, err := parseArgs(query, values); err != nil {
+		return "", err
+	}
+
+	return topic, nil
+}
+
+func parseArgs(query config.LiveQuery, values string) ([]interface{}, error) {
+	if len(query.Params) == 0 {
+		if values != "" {
+			return nil, fmt.Errorf("%s has no parameters", query.Name)
+		}
+		return nil, nil
+	}
+
+	parts := strings.Split(values, ",")
+	if len(parts) != len(query.Params) {
+		return nil, fmt.Errorf("%s has parameters %s", query.Name, strings.Join(query.Params, ", "))
+	}
+
+	args := make([]interface{}, len(parts))
+	for i, part := range parts {
+		value, err := url.QueryUnescape(part)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value of parameter %s: %w", query.Params[i], err)
+		}
+		args[i] = value
+	}
+
+	return args, nil
+}
+
+// Subscribe sends the subscriber the result of a live query and then the
+// changes to it, the topic has to be resolved
+func (m *Manager) Subscribe(sub *pubsub.Subscriber, topic string, requestId string) error {
+	name, values, _ := strings.Cut(strings.TrimPrefix(topic, pubsub.QueryPrefix), ":")
+	query, ok := m.queries[name]
+	if !ok {
+		return fmt.Errorf("%w %s", ErrUnknownQuery, name)
+	}
+
+	args, err := parseArgs(query, values)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	inst, ok := m.instances[topic]
+	if !ok {
+		inst = &instance{
+			topic:       topic,
+			query:       query,
+			args:        args,
+			subscribers: make(map[*pubsub.Subscriber]string),
+			stale:       make(chan struct{}, 1),
+		}
+		m.instances[topic] = inst
+		go inst.run()
+	}
+
+	inst.add(sub, requestId)
+	return nil
+}
+
+// Unsubscribe stops sending a live query to the subscriber
+func (m *Manager) Unsubscribe(sub *pubsub.Subscriber, topic string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	inst, ok := m.instances[topic]
+	if !ok || !inst.remove(sub) {
+		return ErrNotWatching
+	}
+	if inst.empty() {
+		m.stop(inst)
+	}
+
+	return nil
+}
+
+// RemoveSubscriber stops every live query of a closed connection
+func (m *Manager) RemoveSubscriber(sub *pubsub.Subscriber) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, inst := range m.instances {
+		if inst.remove(sub) && inst.empty() {
+			m.stop(inst)
+		}
+	}
+}
+
+func (m *Manager) stop(inst *instance) {
+	delete(m.instances, inst.topic)
+	close(inst.stale)
+}
+
+// changed marks the instances of the queries reading the table of a
+// published event, they run again as soon as they are done with the last run
+func (m *Manager) changed(topic string, message map[string]string) {
+	_, table, _ := strings.Cut(topic, ":")
+	names, ok := m.tables[table]
+	if !ok {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, inst := range m.instances {
+		for _, name := range names {
+			if inst.query.Name == name {
+				inst.markStale()
+				break
+			}
+		}
+	}
+}
+
+func (inst *instance) markStale() {
+	select {
+	case inst.stale <- struct{}{}:
+	default:
+		// a run is already pending, it sees this change too
+	}
+}
+
+func (inst *instance) add(sub *pubsub.Subscriber, requestId string) {
+	inst.mu.Lock()
+	defer inst.mu.Unlock()
+
+	inst.subscribers[sub] = requestId
+
+	// later subscribers start with the result the others have, the first
+	// one gets it from the first run
+	if inst.loaded {
+		sub.SendFrame(pubsub.Frame{Type: pubsub.FrameResult, Id: requestId, Topic: inst.topic, Rows: inst.last})
+	} else {
+		inst.markStale()
+	}
+}
+
+func (inst *instance) remove(sub *pubsub.Subscriber) bool {
+	inst.mu.Lock()
+	defer inst.mu.Unlock()
+
+	if _, ok := inst.subscribers[sub]; !ok {
+		return false
+	}
+
+	delete(inst.subscribers, sub)
+	return true
+}
+
+func (inst *instance) empty() bool {
+	inst.mu.Lock()
+	defer inst.mu.Unlock()
+
+	return len(inst.subscribers) == 0
+}
+
+func (inst *instance) run() {
+	for range inst.stale {
+		rows, err := adapters.Query(inst.query.SQL, inst.args...)
+		if err != nil {
+			log.Printf("error running live query %s: %v", inst.topic, err)
+			inst.send(pubsub.Frame{Type: pubsub.FrameError, Topic: inst.topic, Error: "live query failed"})
+			continue
+		}
+
+		inst.update(rows)
+	}
+}
+
+// update replaces the result and sends the difference to the last one
+func (inst *instance) update(rows []map[string]string) {
+	inst.mu.Lock()
+	defer inst.mu.Unlock()
+
+	next := make(map[string]map[string]string, len(rows))
+	for _, row := range rows {
+		next[inst.rowKey(row)] = row
+	}
+
+	previous, previousRows := inst.last, inst.rows
+	inst.rows, inst.last = next, rows
+
+	if !inst.loaded {
+		inst.loaded = true
+		for sub, requestId := range inst.subscribers {
+			sub.SendFrame(pubsub.Frame{Type: pubsub.FrameResult, Id: requestId, Topic: inst.topic, Rows: rows})
+		}
+		return
+	}
+
+	var diff pubsub.Frame
+	for _, row := range rows {
+		old, ok := previousRows[inst.rowKey(row)]
+		if !ok {
+			diff.Added = append(diff.Added, row)
+		} else if !maps.Equal(old, row) {
+			diff.Changed = append(diff.Changed, row)
+		}
+	}
+	for _, row := range previous {
+		if _, ok := next[inst.rowKey(row)]; !ok {
+			diff.Removed = append(diff.Removed, row)
+		}
+	}
+
+	if diff.Added == nil && diff.Removed == nil && diff.Changed == nil {
+		return
+	}
+
+	diff.Type = pubsub.FrameDiff
+	diff.Topic = inst.topic
+	for sub := range inst.subscribers {
+		sub.SendFrame(diff)
+	}
+}
+
+func (inst *instance) send(frame pubsub.Frame) {
+	inst.mu.Lock()
+	defer inst.mu.Unlock()
+
+	for sub := range inst.subscribers {
+		sub.SendFrame(frame)
+	}
+}
+
+// rowKey returns the values of the key columns of a result row
+func (inst *instance) rowKey(row map[string]string) string {
+	key := inst.query.Key
+	if len(key) == 0 {
+		key = defaultKey
+	}
+
+	values := make([]string, len(key))
+	for i, column := range key {
+		values[i] = row[column]
+	}
+
+	return strings.Join(values, "\x00")
+}
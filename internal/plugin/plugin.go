@@ -0,0 +1,313 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"realtimer/internal/aggregate"
+	"realtimer/internal/config"
+	"realtimer/internal/pubsub"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+)
+
+// Plugins are WebAssembly modules run by wazero, every event they are given
+// goes in and the events they return are published instead. A plugin
+// exports:
+//
+//	memory                          its linear memory
+//	alloc(size i32) -> i32          a buffer of size bytes the event is
+//	                                written to, it belongs to the plugin
+//	process(ptr i32, len i32) -> i64
+//	                                reads the event at ptr and returns the
+//	                                events to publish as ptr<<32 | len, 0
+//	                                for none. They have to stay readable
+//	                                until the next call.
+//
+// The event is JSON {"topic":"insert:orders","data":{"id":"42"}}, the
+// plugin returns a JSON array of them, with string values only. It can
+// import realtimer.log(ptr i32, len i32) to log a message, and the wasip1
+// functions, without files, network or a real clock. Modules built as wasip1
+// reactors have their _initialize function run first.
+//
+// A plugin runs one event at a time. When it takes longer than its timeout,
+// traps or returns invalid events, the event is dropped, or published
+// unchanged with on_error: pass, and the plugin starts again from a new
+// instance.
+
+const (
+	defaultTimeout   = 100 * time.Millisecond
+	defaultMaxMemory = 64 // MB
+	pagesPerMB       = 16 // of 64KB
+)
+
+// What happens to an event a plugin fails on
+const (
+	onErrorDrop = "drop"
+	onErrorPass = "pass"
+)
+
+type plugin struct {
+	name    string
+	topics  []string
+	timeout time.Duration
+	pass    bool // events the plugin fails on are published unchanged
+
+	runtime  wazero.Runtime
+	compiled wazero.CompiledModule
+
+	mu     sync.Mutex
+	module api.Module // nil until the first event and after a failure
+}
+
+// Load compiles the configured plugins and adds them as stages of the
+// published events, in the order of the config
+func Load(cfg config.DBConfig, pubsubManager *pubsub.SubscriptionManager) error {
+	for _, c := range cfg.Plugins {
+		p, err := newPlugin(c)
+		if err != nil {
+			return fmt.Errorf("invalid plugin %s: %w", c.Name, err)
+		}
+		pubsubManager.UseExpander(p.process)
+	}
+
+	return nil
+}
+
+func newPlugin(cfg config.Plugin) (*plugin, error) {
+	if cfg.Name == "" || cfg.Path == "" {
+		return nil, errors.New("name and path are required")
+	}
+
+	switch cfg.OnError {
+	case "", onErrorDrop, onErrorPass:
+	default:
+		return nil, fmt.Errorf("on_error has to be %s or %s", onErrorDrop, onErrorPass)
+	}
+
+	code, err := os.ReadFile(cfg.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	timeout := cfg.Timeout
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+
+	maxMemory := cfg.MaxMemory
+	if maxMemory <= 0 {
+		maxMemory = defaultMaxMemory
+	}
+
+	ctx := context.Background()
+	runtime := wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfig().
+		WithMemoryLimitPages(uint32(maxMemory*pagesPerMB)).
+		WithCloseOnContextDone(true))
+
+	p := &plugin{
+		name:    cfg.Name,
+		topics:  cfg.Topics,
+		timeout: timeout,
+		pass:    cfg.OnError == onErrorPass,
+		runtime: runtime,
+	}
+
+	if err := p.instantiateHost(ctx); err != nil {
+		runtime.Close(ctx)
+		return nil, err
+	}
+
+	p.compiled, err = runtime.CompileModule(ctx, code)
+	if err != nil {
+		runtime.Close(ctx)
+		return nil, err
+	}
+
+	for _, export := range []string{"alloc", "process"} {
+		if _, ok := p.compiled.ExportedFunctions()[export]; !ok {
+			runtime.Close(ctx)
+			return nil, fmt.Errorf("%s is not exported", export)
+		}
+	}
+
+	// the first instance is made now so that a module failing to start is
+	// found before any event
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, err := p.instance(); err != nil {
+		runtime.Close(ctx)
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// instantiateHost adds the functions a plugin can import
+func (p *plugin) instantiateHost(ctx context.Context) error {
+	if _, err := wasi_snapshot_preview1.Instantiate(ctx, p.runtime); err != nil {
+		return err
+	}
+
+	_, err := p.runtime.NewHostModuleBuilder("realtimer").
+		NewFunctionBuilder().
+		WithFunc(func(ctx context.Context, m api.Module, ptr uint32, size uint32) {
+			if message, ok := m.Memory().Read(ptr, size); ok {
+				log.Printf("plugin %s: %s", p.name, message)
+			}
+		}).
+		Export("log").
+		Instantiate(ctx)
+	return err
+}
+
+// instance returns the running instance of the plugin, starting one when
+// there is none. p.mu has to be held.
+func (p *plugin) instance() (api.Module, error) {
+	if p.module != nil {
+		return p.module, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), p.timeout)
+	defer cancel()
+
+	module, err := p.runtime.InstantiateModule(ctx, p.compiled, wazero.NewModuleConfig().
+		WithName("").
+		WithStartFunctions("_initialize").
+		WithStderr(log.Writer()))
+	if err != nil {
+		return nil, err
+	}
+
+	p.module = module
+	return module, nil
+}
+
+// process is the pubsub stage running the plugin on an event, a failed run
+// is logged and drops the event, or publishes it unchanged when the plugin
+// passes events on errors
+func (p *plugin) process(topic string, message map[string]string) []pubsub.Event {
+	event := pubsub.Event{Topic: topic, Data: message}
+	if !p.matches(topic) {
+		return []pubsub.Event{event}
+	}
+
+	events, err := p.run(event)
+	if err != nil {
+		log.Printf("error running plugin %s on %s: %v", p.name, topic, err)
+		if p.pass {
+			return []pubsub.Event{event}
+		}
+		return nil
+	}
+
+	return events
+}
+
+func (p *plugin) matches(topic string) bool {
+	if len(p.topics) == 0 {
+		return true
+	}
+
+	for _, pattern := range p.topics {
+		if pubsub.MatchTopic(pattern, topic) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (p *plugin) run(event pubsub.Event) ([]pubsub.Event, error) {
+	input, err := json.Marshal(event)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	module, err := p.instance()
+	if err != nil {
+		return nil, err
+	}
+
+	output, err := p.call(module, input)
+	if err != nil {
+		// the instance may be closed or broken, the next event gets a new one
+		module.Close(context.Background())
+		p.module = nil
+		return nil, err
+	}
+
+	var events []pubsub.Event
+	if len(output) > 0 {
+		if err := json.Unmarshal(output, &events); err != nil {
+			return nil, fmt.Errorf("invalid events: %w", err)
+		}
+	}
+
+	for i, e := range events {
+		if e.Topic == "" || pubsub.IsPattern(e.Topic) || reserved(e.Topic) {
+			return nil, fmt.Errorf("invalid topic %q", e.Topic)
+		}
+		if e.Data == nil {
+			events[i].Data = make(map[string]string)
+		}
+	}
+
+	return events, nil
+}
+
+// call passes input to the plugin and returns a copy of its output
+func (p *plugin) call(module api.Module, input []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), p.timeout)
+	defer cancel()
+
+	results, err := module.ExportedFunction("alloc").Call(ctx, uint64(len(input)))
+	if err != nil {
+		return nil, fmt.Errorf("alloc: %w", err)
+	}
+
+	ptr := uint32(results[0])
+	if !module.Memory().Write(ptr, input) {
+		return nil, fmt.Errorf("alloc returned %d, out of memory", ptr)
+	}
+
+	results, err = module.ExportedFunction("process").Call(ctx, uint64(ptr), uint64(len(input)))
+	if err != nil {
+		return nil, fmt.Errorf("process: %w", err)
+	}
+
+	if results[0] == 0 {
+		return nil, nil
+	}
+
+	outPtr, outLen := uint32(results[0]>>32), uint32(results[0])
+	output, ok := module.Memory().Read(outPtr, outLen)
+	if !ok {
+		return nil, fmt.Errorf("process returned %d bytes at %d, out of memory", outLen, outPtr)
+	}
+
+	// the memory is reused by the next call
+	return append([]byte(nil), output...), nil
+}
+
+// reserved reports whether a topic is one plugins cannot publish on
+func reserved(topic string) bool {
+	for _, prefix := range []string{pubsub.BroadcastPrefix, pubsub.QueryPrefix, aggregate.TopicPrefix} {
+		if strings.HasPrefix(topic, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,152 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"realtimer/internal/config"
+	"realtimer/internal/pubsub"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// example is plugins/example compiled to a wasip1 reactor, empty when it
+// could not be built
+var example string
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+
+	dir, err := os.MkdirTemp("", "plugin")
+	if err != nil {
+		panic(err)
+	}
+
+	if !testing.Short() {
+		path := filepath.Join(dir, "example.wasm")
+		cmd := exec.Command("go", "build", "-buildmode=c-shared", "-o", path, ".")
+		cmd.Dir = filepath.Join("..", "..", "plugins", "example")
+		cmd.Env = append(os.Environ(), "GOOS=wasip1", "GOARCH=wasm")
+		if output, err := cmd.CombinedOutput(); err == nil {
+			example = path
+		} else {
+			log.Printf("cannot build the example plugin: %v\n%s", err, output)
+		}
+	}
+
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+func newExample(t *testing.T, onError string) *plugin {
+	t.Helper()
+
+	if example == "" {
+		t.Skip("the example plugin is not built")
+	}
+
+	p, err := newPlugin(config.Plugin{Name: "example", Path: example, OnError: onError})
+	if err != nil {
+		t.Fatalf("loading the example plugin: %v", err)
+	}
+
+	return p
+}
+
+func TestExample(t *testing.T) {
+	p := newExample(t, "")
+	defer p.runtime.Close(context.Background())
+
+	tests := []struct {
+		name    string
+		topic   string
+		message map[string]string
+		want    []pubsub.Event
+	}{
+		{
+			name:    "unchanged",
+			topic:   "insert:orders",
+			message: map[string]string{"id": "1", "amount": "10"},
+			want:    []pubsub.Event{{Topic: "insert:orders", Data: map[string]string{"id": "1", "amount": "10"}}},
+		},
+		{
+			name:    "dropped",
+			topic:   "insert:orders",
+			message: map[string]string{"id": "2", "test": "true"},
+			want:    nil,
+		},
+		{
+			name:    "expanded",
+			topic:   "insert:orders",
+			message: map[string]string{"id": "3", "amount": "1500"},
+			want: []pubsub.Event{
+				{Topic: "insert:orders", Data: map[string]string{"id": "3", "amount": "1500"}},
+				{Topic: "large:orders", Data: map[string]string{"id": "3", "amount": "1500"}},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := p.process(test.topic, test.message)
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("process(%s, %v) = %v, want %v", test.topic, test.message, got, test.want)
+			}
+		})
+	}
+}
+
+func TestExampleInvalidInput(t *testing.T) {
+	p := newExample(t, "")
+	defer p.runtime.Close(context.Background())
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	module, err := p.instance()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	output, err := p.call(module, []byte("{"))
+	if err != nil {
+		t.Fatalf("call: %v", err)
+	}
+
+	var events []pubsub.Event
+	if err := json.Unmarshal(output, &events); err == nil {
+		t.Errorf("output %q for invalid input is valid", output)
+	}
+}
+
+func TestOnError(t *testing.T) {
+	p := newExample(t, onErrorPass)
+	defer p.runtime.Close(context.Background())
+
+	// no run finishes in time
+	p.timeout = time.Nanosecond
+	event := pubsub.Event{Topic: "insert:orders", Data: map[string]string{"id": "1"}}
+
+	if got, want := p.process(event.Topic, event.Data), []pubsub.Event{event}; !reflect.DeepEqual(got, want) {
+		t.Errorf("on_error pass: process = %v, want %v", got, want)
+	}
+
+	p.pass = false
+	if got := p.process(event.Topic, event.Data); got != nil {
+		t.Errorf("on_error drop: process = %v, want nothing", got)
+	}
+}
+
+func TestInvalidOnError(t *testing.T) {
+	_, err := newPlugin(config.Plugin{Name: "example", Path: "example.wasm", OnError: "retry"})
+	if err == nil || !strings.Contains(err.Error(), "on_error") {
+		t.Errorf("on_error retry: err = %v", err)
+	}
+}
@@ -0,0 +1,35 @@
+package pubsub
+
+// A token can carry a "topics" claim, the topics and topic patterns its
+// connections may use. A topic is allowed when every topic it matches is
+// matched by one of them, a row topic also when its table's topic is.
+// Tokens without the claim can use any topic except the ones of routes
+// taking a field of the row, like the topics of a tenant, which have to be
+// claimed.
+
+// Allowed reports whether a topic or pattern is allowed with the topics
+// claimed by a token, claims is nil when the token has no such claim
+func (s *SubscriptionManager) Allowed(claims []string, topic string) bool {
+	table := topic
+	if event, name, _, ok := parseRowTopic(topic); ok {
+		table = event + ":" + name
+	}
+
+	if claims == nil {
+		segments := splitTopic(table)
+		for _, r := range s.routeList {
+			if r.restricted && r.reaches(segments, 0) {
+				return false
+			}
+		}
+		return true
+	}
+
+	for _, claim := range claims {
+		if coversTopic(claim, topic) || coversTopic(claim, table) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,114 @@
+package pubsub
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BroadcastPrefix starts the topics of broadcast channels, messages clients
+// send each other without going through the database
+const BroadcastPrefix = "broadcast:"
+
+const (
+	defaultBroadcastRate = 20
+	maxBroadcastBytes    = 4096
+)
+
+var (
+	ErrNotBroadcast      = errors.New("only broadcast: topics can be published to")
+	ErrBroadcastTooLarge = errors.New("broadcast message too large")
+	ErrRateLimited       = errors.New("rate limit exceeded")
+)
+
+// limiter is a token bucket allowing rate messages per second with bursts of
+// up to burst messages
+type limiter struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newLimiter(rate float64, burst int) *limiter {
+	return &limiter{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+func (l *limiter) allow() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.tokens = min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+// Broadcast sends a client's message to the other subscribers of a broadcast
+// channel. The message is not numbered or kept for replay, subscribers that
+// are away miss it.
+func (s *SubscriptionManager) Broadcast(sender *Subscriber, topic string, message map[string]string) error {
+	if !strings.HasPrefix(topic, BroadcastPrefix) || IsPattern(topic) {
+		return ErrNotBroadcast
+	}
+
+	size := 0
+	for key, value := range message {
+		size += len(key) + len(value)
+	}
+	if size > maxBroadcastBytes {
+		return ErrBroadcastTooLarge
+	}
+
+	if !sender.limiter.allow() {
+		return ErrRateLimited
+	}
+
+	frameData, err := json.Marshal(Frame{Type: FrameEvent, Topic: topic, Data: message, Subscriber: sender.Id})
+	if err != nil {
+		return err
+	}
+	rawData, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	seen := map[*Subscriber]struct{}{sender: {}}
+	deliver := func(subscription *Subscription) {
+		// table patterns like *:orders do not pick up client messages
+		if !strings.HasPrefix(subscription.Topic, BroadcastPrefix) {
+			return
+		}
+		if _, ok := seen[subscription.Subscriber]; ok {
+			return
+		}
+		if !subscription.Filter.Match(message) {
+			return
+		}
+
+		seen[subscription.Subscriber] = struct{}{}
+		if subscription.Raw {
+			subscription.Subscriber.Send(rawData)
+		} else {
+			subscription.Subscriber.Send(frameData)
+		}
+	}
+
+	for _, subscription := range s.subscribers[topic] {
+		deliver(subscription)
+	}
+	s.patterns.match(topic, deliver)
+
+	return nil
+}
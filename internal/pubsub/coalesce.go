@@ -0,0 +1,152 @@
+package pubsub
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MaxCoalesceWindow is the longest a subscription can hold back events
+const MaxCoalesceWindow = time.Minute
+
+var ErrCoalesceWindow = errors.New("coalesce window has to be between 0 and 1m")
+
+// coalescer holds back the events of each row for a window and then emits
+// only the latest version. The window starts with the first event of the row,
+// an insert followed by a delete emits nothing.
+type coalescer struct {
+	window time.Duration
+	emit   func(event *coalescedEvent)
+
+	mu      sync.Mutex
+	pending map[string]*coalescedEvent // by table and row key
+	stopped bool
+}
+
+// coalescedEvent is the latest version of a row, event is the event it is
+// emitted as
+type coalescedEvent struct {
+	first   string // event that started the window
+	last    string // event of message and frame
+	event   string
+	table   string
+	seq     uint64
+	message map[string]string
+	frame   []byte // encoded for the last event, nil for table coalescing
+	dropped bool
+}
+
+func newCoalescer(window time.Duration, emit func(event *coalescedEvent)) *coalescer {
+	return &coalescer{
+		window:  window,
+		emit:    emit,
+		pending: make(map[string]*coalescedEvent),
+	}
+}
+
+// add merges an event into the pending version of its row
+func (c *coalescer) add(key string, topic string, seq uint64, message map[string]string, frame []byte) {
+	event, table, _ := strings.Cut(topic, ":")
+	key = table + "\x00" + key
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.stopped {
+		return
+	}
+
+	pending, ok := c.pending[key]
+	if !ok {
+		pending = &coalescedEvent{first: event, table: table}
+		c.pending[key] = pending
+		time.AfterFunc(c.window, func() { c.flush(key) })
+	}
+
+	pending.event, pending.dropped = mergeEvents(pending.first, event)
+	pending.last = event
+	pending.seq = seq
+	pending.message = message
+	pending.frame = frame
+}
+
+func (c *coalescer) flush(key string) {
+	c.mu.Lock()
+	pending, ok := c.pending[key]
+	delete(c.pending, key)
+	stopped := c.stopped
+	c.mu.Unlock()
+
+	if !ok || stopped || pending.dropped {
+		return
+	}
+
+	c.emit(pending)
+}
+
+// stop drops the pending events, nothing is emitted anymore
+func (c *coalescer) stop() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.stopped = true
+	c.pending = nil
+}
+
+// mergeEvents returns the event a row is emitted as when its window started
+// with first and ended with last, dropped is true when the row did not exist
+// before or after the window
+func mergeEvents(first string, last string) (event string, dropped bool) {
+	switch {
+	case first == "insert" && last == "delete":
+		return "", true
+	case first == "insert":
+		return "insert", false
+	case first == "delete" && last != "delete":
+		return "update", false
+	default:
+		return last, false
+	}
+}
+
+// topic returns the topic of the emitted event
+func (event *coalescedEvent) topic() string {
+	return event.event + ":" + event.table
+}
+
+// encode returns the event frame of the emitted event, the frame of the last
+// event is reused when it was not merged into another event
+func (event *coalescedEvent) encode(fields []string) ([]byte, error) {
+	if event.frame != nil && event.event == event.last {
+		return event.frame, nil
+	}
+
+	return json.Marshal(Frame{Type: FrameEvent, Topic: event.topic(), Seq: event.seq, Data: project(event.message, fields)})
+}
+
+// isRowEvent reports whether a topic carries row changes, which can be
+// coalesced
+func isRowEvent(topic string) bool {
+	event, _, _ := strings.Cut(topic, ":")
+	return event == "insert" || event == "update" || event == "replace" || event == "delete"
+}
+
+// sendCoalesced sends the latest version of a row to the subscription
+func (subscription *Subscription) sendCoalesced(event *coalescedEvent) {
+	var data []byte
+	var err error
+	if subscription.Raw {
+		data, err = json.Marshal(project(event.message, subscription.Fields))
+	} else {
+		data, err = event.encode(subscription.Fields)
+	}
+	if err != nil {
+		log.Printf("error encoding coalesced event of %s: %v", event.table, err)
+		return
+	}
+
+	subscription.send(data)
+}
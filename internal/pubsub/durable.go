@@ -0,0 +1,300 @@
+package pubsub
+
+import (
+	"cmp"
+	"errors"
+	"log"
+	"realtimer/internal/eventlog"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	defaultAckTimeout = 30 * time.Second
+	defaultMaxUnacked = 1000
+	redeliverInterval = time.Second
+)
+
+var (
+	ErrNotDurable = errors.New("no durable subscription")
+	ErrAckTopic   = errors.New("topic is required with several durable subscriptions")
+)
+
+type durableKey struct {
+	subscriber string
+	topic      string
+}
+
+// durable is the delivery state of a durable subscription. It outlives the
+// connection, a subscriber reconnecting with the same id and topic continues
+// after the last event it acknowledged.
+type durable struct {
+	key durableKey
+
+	mu      sync.Mutex
+	acked   uint64
+	pending []pendingEvent // sent and not acknowledged yet, in order of seq
+	// subscription is the one currently receiving the events, nil while the
+	// subscriber is away
+	subscription *Subscription
+}
+
+type pendingEvent struct {
+	seq   uint64
+	frame []byte
+	sent  time.Time
+}
+
+// track keeps an event sent to the subscription until it is acknowledged, it
+// returns false when the subscriber has too many unacknowledged events
+func (d *durable) track(seq uint64, frame []byte, maxUnacked int) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if seq <= d.acked {
+		return true
+	}
+	if len(d.pending) >= maxUnacked {
+		return false
+	}
+
+	d.insertLocked(pendingEvent{seq: seq, frame: frame, sent: time.Now()})
+	return true
+}
+
+// insertLocked adds a pending event in order of seq, live events can be
+// tracked before the older ones of a replay. d.mu has to be held.
+func (d *durable) insertLocked(event pendingEvent) {
+	i, found := slices.BinarySearchFunc(d.pending, event.seq, func(pending pendingEvent, seq uint64) int {
+		return cmp.Compare(pending.seq, seq)
+	})
+	if !found {
+		d.pending = slices.Insert(d.pending, i, event)
+	}
+}
+
+// ack acknowledges every event of the subscription up to and including seq
+func (d *durable) ack(seq uint64) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if seq <= d.acked {
+		return false
+	}
+	d.acked = seq
+
+	d.pending = slices.DeleteFunc(d.pending, func(event pendingEvent) bool {
+		return event.seq <= seq
+	})
+
+	return true
+}
+
+// detach stops sending to a subscription that went away, the events it did
+// not acknowledge are replayed from the history when it comes back
+func (d *durable) detach(subscription *Subscription) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.subscription == subscription {
+		d.subscription = nil
+		d.pending = nil
+	}
+}
+
+// redeliver sends the events again that were not acknowledged in time
+func (d *durable) redeliver(now time.Time, timeout time.Duration) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	// events held back during the replay are not sent yet
+	if d.subscription == nil || d.subscription.isReplaying() {
+		return
+	}
+
+	for i := range d.pending {
+		if now.Sub(d.pending[i].sent) < timeout {
+			continue
+		}
+
+		d.pending[i].sent = now
+		d.subscription.Subscriber.Send(d.pending[i].frame)
+	}
+}
+
+// SubscribeDurable adds a durable subscription. Its events have to be
+// acknowledged and are sent again until they are. The first time a subscriber
+// id subscribes to a topic it starts at resumeFrom, or with the next event
+// when it is nil, later it continues after the last acknowledged event, also
+// across restarts when the event log is enabled. A connection taking over a
+// durable subscription ends it on the connection that had it.
+func (s *SubscriptionManager) SubscribeDurable(subscription *Subscription, resumeFrom *uint64, requestId string) {
+	s.mu.Lock()
+	key := durableKey{subscriber: subscription.Subscriber.Id, topic: subscription.Topic}
+	d, ok := s.durables[key]
+	if !ok {
+		d = &durable{key: key, acked: s.delivered.Load()}
+		if resumeFrom != nil {
+			d.acked = *resumeFrom
+		}
+		s.durables[key] = d
+		s.cursorsChanged = true
+	}
+
+	if previous := d.subscription; previous != nil && previous.Subscriber != subscription.Subscriber {
+		delete(previous.Subscriber.subscriptions, previous.Topic)
+		s.removeSubscription(previous)
+		previous.Subscriber.SendFrame(Frame{Type: FrameError, Topic: previous.Topic, Error: "subscription taken over by another connection"})
+	}
+
+	d.mu.Lock()
+	d.subscription = subscription
+	d.pending = nil
+	after := d.acked
+	d.mu.Unlock()
+
+	// like SubscribeFrom, the unacknowledged events are replayed without
+	// blocking publishing
+	subscription.durable = d
+	subscription.replaying = true
+	s.subscribeLocked(subscription)
+	upto := s.delivered.Load()
+	s.mu.Unlock()
+
+	events, gap := s.history.since(subscription.matchTopic, after, upto)
+	if gap {
+		// the client reloads its state, there is nothing left to redeliver
+		subscription.Subscriber.SendFrame(Frame{Type: FrameResync, Id: requestId, Topic: subscription.Topic})
+		d.mu.Lock()
+		d.acked = max(d.acked, upto)
+		d.mu.Unlock()
+
+		s.mu.Lock()
+		s.cursorsChanged = true
+		s.mu.Unlock()
+	} else {
+		var replayed []pendingEvent
+		for _, event := range events {
+			if s.matchRow(subscription, event.topic, event.message) && subscription.Filter.Match(event.message) {
+				frame := event.encode(subscription)
+				subscription.Subscriber.Send(frame)
+				replayed = append(replayed, pendingEvent{seq: event.seq, frame: frame, sent: time.Now()})
+			}
+		}
+
+		d.mu.Lock()
+		if d.subscription == subscription {
+			for _, event := range replayed {
+				d.insertLocked(event)
+			}
+		}
+		d.mu.Unlock()
+	}
+
+	subscription.endReplay()
+}
+
+// Ack acknowledges the events up to and including seq on the durable
+// subscription of the subscriber to topic. The topic can be left out when
+// the subscriber has a single durable subscription.
+func (s *SubscriptionManager) Ack(sub *Subscriber, topic string, seq uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var d *durable
+	if topic != "" {
+		subscription, ok := sub.subscriptions[topic]
+		if !ok || subscription.durable == nil {
+			return ErrNotDurable
+		}
+		d = subscription.durable
+	} else {
+		for _, subscription := range sub.subscriptions {
+			if subscription.durable == nil {
+				continue
+			}
+			if d != nil {
+				return ErrAckTopic
+			}
+			d = subscription.durable
+		}
+		if d == nil {
+			return ErrNotDurable
+		}
+	}
+
+	if d.ack(seq) {
+		s.cursorsChanged = true
+	}
+
+	return nil
+}
+
+// dropDurable forgets a durable subscription the client ended itself
+func (s *SubscriptionManager) dropDurable(subscription *Subscription) {
+	if subscription.durable == nil {
+		return
+	}
+
+	delete(s.durables, subscription.durable.key)
+	s.cursorsChanged = true
+}
+
+func (s *SubscriptionManager) loadCursors() {
+	if s.store == nil {
+		return
+	}
+
+	cursors, err := s.store.LoadCursors()
+	if err != nil {
+		log.Printf("error loading durable subscriptions: %v", err)
+		return
+	}
+
+	for subscriber, topics := range cursors {
+		for topic, acked := range topics {
+			key := durableKey{subscriber: subscriber, topic: topic}
+			s.durables[key] = &durable{key: key, acked: acked}
+		}
+	}
+}
+
+// redeliverLoop sends unacknowledged events again and stores the positions
+// of the durable subscriptions when they changed
+func (s *SubscriptionManager) redeliverLoop() {
+	ticker := time.NewTicker(min(redeliverInterval, s.ackTimeout))
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		s.mu.Lock()
+		for _, d := range s.durables {
+			d.redeliver(now, s.ackTimeout)
+		}
+
+		var cursors eventlog.Cursors
+		if s.cursorsChanged && s.store != nil {
+			cursors = make(eventlog.Cursors)
+			for key, d := range s.durables {
+				if cursors[key.subscriber] == nil {
+					cursors[key.subscriber] = make(map[string]uint64)
+				}
+				d.mu.Lock()
+				cursors[key.subscriber][key.topic] = d.acked
+				d.mu.Unlock()
+			}
+		}
+		s.cursorsChanged = false
+		s.mu.Unlock()
+
+		if cursors != nil {
+			if err := s.store.SaveCursors(cursors); err != nil {
+				log.Printf("error storing durable subscriptions: %v", err)
+
+				s.mu.Lock()
+				s.cursorsChanged = true
+				s.mu.Unlock()
+			}
+		}
+	}
+}
@@ -0,0 +1,227 @@
+package pubsub
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Filter is a condition over the fields of a published row, evaluated before
+// the row is sent to a subscription. A filter is either a combination of
+// filters:
+//
+//	{"and": [...]}  {"or": [...]}  {"not": {...}}
+//
+// or a comparison of one field:
+//
+//	{"field": "driver_id", "op": "eq", "value": 7}
+//	{"field": "status", "op": "in", "values": ["open", "pending"]}
+//	{"field": "deleted_at", "op": "is_null"}
+//
+// Comparisons are eq, neq, gt, gte, lt, lte, in, like (SQL wildcards % and _),
+// is_null and is_not_null. Values are compared as numbers when both sides are
+// numeric and as strings otherwise.
+type Filter struct {
+	And []*Filter `json:"and,omitempty"`
+	Or  []*Filter `json:"or,omitempty"`
+	Not *Filter   `json:"not,omitempty"`
+
+	Field  string            `json:"field,omitempty"`
+	Op     string            `json:"op,omitempty"`
+	Value  json.RawMessage   `json:"value,omitempty"`
+	Values []json.RawMessage `json:"values,omitempty"`
+
+	value  string
+	values []string
+	like   *regexp.Regexp
+}
+
+// Compile validates the filter and prepares its values, it has to be called
+// before Match
+func (f *Filter) Compile() error {
+	switch {
+	case len(f.And) > 0:
+		return compileAll(f.And)
+	case len(f.Or) > 0:
+		return compileAll(f.Or)
+	case f.Not != nil:
+		return f.Not.Compile()
+	}
+
+	if f.Field == "" {
+		return fmt.Errorf("filter needs and, or, not or a field")
+	}
+
+	switch f.Op {
+	case "is_null", "is_not_null":
+		return nil
+	case "eq", "neq", "gt", "gte", "lt", "lte", "like":
+		value, err := filterValue(f.Value)
+		if err != nil {
+			return fmt.Errorf("invalid value for field %s: %w", f.Field, err)
+		}
+		f.value = value
+	case "in":
+		if len(f.Values) == 0 {
+			return fmt.Errorf("in filter on field %s needs values", f.Field)
+		}
+		f.values = make([]string, 0, len(f.Values))
+		for _, raw := range f.Values {
+			value, err := filterValue(raw)
+			if err != nil {
+				return fmt.Errorf("invalid value for field %s: %w", f.Field, err)
+			}
+			f.values = append(f.values, value)
+		}
+	default:
+		return fmt.Errorf("unknown filter operator %q", f.Op)
+	}
+
+	if f.Op == "like" {
+		f.like = likePattern(f.value)
+	}
+
+	return nil
+}
+
+func compileAll(filters []*Filter) error {
+	for _, filter := range filters {
+		if filter == nil {
+			return fmt.Errorf("empty filter")
+		}
+		if err := filter.Compile(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// filterValue reads a JSON scalar as the string form used in published rows
+func filterValue(raw json.RawMessage) (string, error) {
+	if len(raw) == 0 {
+		return "", fmt.Errorf("value is missing")
+	}
+
+	var value interface{}
+	decoder := json.NewDecoder(strings.NewReader(string(raw)))
+	decoder.UseNumber()
+	if err := decoder.Decode(&value); err != nil {
+		return "", err
+	}
+
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case json.Number:
+		return v.String(), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case nil:
+		return "NULL", nil
+	default:
+		return "", fmt.Errorf("value must be a string, number or boolean")
+	}
+}
+
+func likePattern(pattern string) *regexp.Regexp {
+	var expr strings.Builder
+	expr.WriteString("^")
+	for _, r := range pattern {
+		switch r {
+		case '%':
+			expr.WriteString(".*")
+		case '_':
+			expr.WriteString(".")
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	expr.WriteString("$")
+
+	return regexp.MustCompile(expr.String())
+}
+
+// Match reports whether a row passes the filter, a nil filter matches
+// everything
+func (f *Filter) Match(row map[string]string) bool {
+	if f == nil {
+		return true
+	}
+
+	switch {
+	case len(f.And) > 0:
+		for _, filter := range f.And {
+			if !filter.Match(row) {
+				return false
+			}
+		}
+		return true
+	case len(f.Or) > 0:
+		for _, filter := range f.Or {
+			if filter.Match(row) {
+				return true
+			}
+		}
+		return false
+	case f.Not != nil:
+		return !f.Not.Match(row)
+	}
+
+	value, ok := row[f.Field]
+	isNull := !ok || value == "NULL"
+
+	switch f.Op {
+	case "is_null":
+		return isNull
+	case "is_not_null":
+		return !isNull
+	}
+
+	if !ok {
+		return false
+	}
+
+	switch f.Op {
+	case "eq":
+		return compareValues(value, f.value) == 0
+	case "neq":
+		return compareValues(value, f.value) != 0
+	case "gt":
+		return compareValues(value, f.value) > 0
+	case "gte":
+		return compareValues(value, f.value) >= 0
+	case "lt":
+		return compareValues(value, f.value) < 0
+	case "lte":
+		return compareValues(value, f.value) <= 0
+	case "like":
+		return f.like.MatchString(value)
+	case "in":
+		for _, v := range f.values {
+			if compareValues(value, v) == 0 {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func compareValues(a, b string) int {
+	af, aErr := strconv.ParseFloat(a, 64)
+	bf, bErr := strconv.ParseFloat(b, 64)
+	if aErr == nil && bErr == nil {
+		switch {
+		case af < bf:
+			return -1
+		case af > bf:
+			return 1
+		default:
+			return 0
+		}
+	}
+
+	return strings.Compare(a, b)
+}
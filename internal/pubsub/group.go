@@ -0,0 +1,84 @@
+package pubsub
+
+import (
+	"hash/fnv"
+	"realtimer/internal/config"
+	"strconv"
+	"strings"
+)
+
+var defaultPrimaryKey = []string{"id"}
+
+// groupKey identifies a consumer group, subscriptions with the same group
+// name and topic share its events
+type groupKey struct {
+	group string
+	topic string
+}
+
+// primaryKeys maps table names, public names and aliases to their primary
+// key columns
+func primaryKeys(tables config.Tables) map[string][]string {
+	keys := make(map[string][]string)
+	for _, table := range tables {
+		if len(table.PrimaryKey) > 0 {
+			keys[table.Name] = table.PrimaryKey
+			for _, name := range publicNames(table) {
+				keys[name] = table.PrimaryKey
+			}
+		}
+	}
+
+	return keys
+}
+
+// topicTable returns the table part of an <event>:<table> topic
+func topicTable(topic string) string {
+	_, table, found := strings.Cut(topic, ":")
+	if !found {
+		return topic
+	}
+
+	return table
+}
+
+// rowKey returns the primary key of a published row, composite keys joined
+// into one string. ok is false for a row without its key columns, it gets an
+// empty key.
+func (s *SubscriptionManager) rowKey(topic string, message map[string]string) (key string, ok bool) {
+	columns := s.keyColumns(topicTable(topic))
+	values := make([]string, len(columns))
+	for i, column := range columns {
+		value, found := message[column]
+		if !found {
+			return "", false
+		}
+		values[i] = value
+	}
+
+	return strings.Join(values, "\x00"), true
+}
+
+// pickMember chooses the group member receiving a row with rendezvous
+// hashing: every member scores the key and the highest score wins. Rows with
+// the same key always go to the same member while the group does not change,
+// so they arrive in order, and a member joining or leaving only moves the
+// keys it takes or had.
+func pickMember(members []delivery, key string) delivery {
+	var chosen delivery
+	var best uint64
+
+	for _, member := range members {
+		h := fnv.New64a()
+		h.Write([]byte(key))
+		h.Write([]byte{0})
+		h.Write([]byte(strconv.FormatUint(member.subscription.Subscriber.member, 10)))
+
+		if score := h.Sum64(); chosen.subscription == nil || score > best {
+			chosen = member
+			best = score
+		}
+	}
+
+	return chosen
+}
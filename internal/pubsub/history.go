@@ -0,0 +1,278 @@
+package pubsub
+
+import (
+	"encoding/json"
+	"log"
+	"realtimer/internal/eventlog"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	defaultReplaySize = 100
+	// the ring of a topic is freed when nothing was published on it for
+	// ringIdleTimeout, checked every ringSweepInterval
+	ringIdleTimeout   = 5 * time.Minute
+	ringSweepInterval = time.Minute
+)
+
+// historyEvent is a published message kept for replay
+type historyEvent struct {
+	seq     uint64
+	topic   string
+	message map[string]string
+	frame   []byte
+}
+
+// encode returns the event frame of a replayed event for a subscription,
+// projected to its fields
+func (event historyEvent) encode(subscription *Subscription) []byte {
+	if len(subscription.Fields) == 0 {
+		return event.frame
+	}
+
+	frame, err := json.Marshal(Frame{Type: FrameEvent, Topic: event.topic, Seq: event.seq, Data: project(event.message, subscription.Fields)})
+	if err != nil {
+		log.Printf("error encoding event %d: %v", event.seq, err)
+		return event.frame
+	}
+
+	return frame
+}
+
+// ring keeps the most recent events of one topic
+type ring struct {
+	events []historyEvent
+	next   int
+	full   bool
+	// evicted is the sequence id of the last event pushed out of the ring,
+	// a resume from before it has missed events
+	evicted uint64
+	pushed  time.Time
+}
+
+func (r *ring) push(event historyEvent, now time.Time) {
+	r.pushed = now
+	if r.full {
+		r.evicted = r.events[r.next].seq
+	}
+
+	r.events[r.next] = event
+	r.next = (r.next + 1) % len(r.events)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// last returns the sequence id of the newest event of the ring
+func (r *ring) last() uint64 {
+	return r.events[(r.next+len(r.events)-1)%len(r.events)].seq
+}
+
+func (r *ring) since(after uint64, upto uint64, events []historyEvent) []historyEvent {
+	n := r.next
+	start := 0
+	if r.full {
+		n = len(r.events)
+		start = r.next
+	}
+
+	for i := 0; i < n; i++ {
+		event := r.events[(start+i)%len(r.events)]
+		if event.seq > after && event.seq <= upto {
+			events = append(events, event)
+		}
+	}
+
+	return events
+}
+
+// history numbers every published event with a sequence id, shared by all
+// topics so a client only has to remember the last id it received, an event
+// routed to several topics has one id. It keeps a ring buffer of recent
+// events per topic, freed when the topic is idle. With an event log the
+// events are also written to disk before they are sent, numbering continues
+// across restarts and replays the rings cannot serve are read from the log.
+type history struct {
+	mu     sync.Mutex
+	size   int
+	seq    uint64
+	topics map[string]*ring
+	store  *eventlog.Log
+	// base is the last sequence id of the previous run, the rings only hold
+	// events published after it
+	base uint64
+	// dropped is the last sequence id of the idle rings that were freed, a
+	// resume from before it may have missed their events
+	dropped uint64
+	swept   time.Time
+}
+
+func newHistory(size int, store *eventlog.Log) *history {
+	h := &history{
+		size:   size,
+		topics: make(map[string]*ring),
+		store:  store,
+	}
+
+	if store != nil {
+		h.seq = store.LastSeq()
+		h.base = h.seq
+	}
+
+	return h
+}
+
+// append assigns the next sequence id to an event published on the given
+// topics, encodes it for each of them and keeps it. Callers serialize it with
+// sending the event, so that subscribers get the ids in order.
+func (h *history) append(topics []string, message map[string]string, encode func(seq uint64, topic string) ([]byte, error)) (uint64, [][]byte, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	seq := h.seq + 1
+	frames := make([][]byte, len(topics))
+	for i, topic := range topics {
+		frame, err := encode(seq, topic)
+		if err != nil {
+			return 0, nil, err
+		}
+		frames[i] = frame
+	}
+	h.seq = seq
+
+	now := time.Now()
+	if h.store != nil {
+		err := h.store.Append(eventlog.Event{Seq: seq, Time: now, Topic: topics[0], Topics: topics[1:], Data: message})
+		if err != nil {
+			log.Printf("error writing event %d to the event log: %v", seq, err)
+		}
+	}
+
+	if h.size > 0 {
+		for i, topic := range topics {
+			r, ok := h.topics[topic]
+			if !ok {
+				r = &ring{events: make([]historyEvent, h.size)}
+				h.topics[topic] = r
+			}
+			r.push(historyEvent{seq: seq, topic: topic, message: message, frame: frames[i]}, now)
+		}
+
+		if now.Sub(h.swept) >= ringSweepInterval {
+			h.sweep(now)
+		}
+	}
+
+	return seq, frames, nil
+}
+
+// sweep frees the rings of the topics nothing was published on for a while,
+// h.mu has to be held
+func (h *history) sweep(now time.Time) {
+	h.swept = now
+	for topic, r := range h.topics {
+		if now.Sub(r.pushed) < ringIdleTimeout {
+			continue
+		}
+
+		h.dropped = max(h.dropped, r.last())
+		delete(h.topics, topic)
+	}
+}
+
+// last returns the sequence id of the last published event
+func (h *history) last() uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.seq
+}
+
+// since returns the events of the topics accepted by match published after
+// the sequence id after and up to upto, in order. gap is true when some of
+// them are no longer buffered, or the id is unknown to this history.
+func (h *history) since(match func(topic string) bool, after uint64, upto uint64) (events []historyEvent, gap bool) {
+	if after > upto {
+		return nil, true
+	}
+	if after == upto {
+		return nil, false
+	}
+
+	if events, ok := h.ringsSince(match, after, upto); ok {
+		return events, false
+	}
+
+	if h.store == nil {
+		return nil, true
+	}
+
+	// the log is read without h.mu, publishing goes on meanwhile
+
+	stored, gap, err := h.store.Since(match, after)
+	if err != nil {
+		log.Printf("error reading the event log: %v", err)
+		return nil, true
+	}
+	if gap {
+		return nil, true
+	}
+
+	events = make([]historyEvent, 0, len(stored))
+	for _, event := range stored {
+		if event.Seq > upto {
+			break
+		}
+
+		// replayed on the first of its topics the subscription matches
+		topic := event.Topic
+		if !match(topic) {
+			if i := slices.IndexFunc(event.Topics, match); i >= 0 {
+				topic = event.Topics[i]
+			}
+		}
+
+		frame, err := json.Marshal(Frame{Type: FrameEvent, Topic: topic, Seq: event.Seq, Data: event.Data})
+		if err != nil {
+			return nil, true
+		}
+		events = append(events, historyEvent{seq: event.Seq, topic: topic, message: event.Data, frame: frame})
+	}
+
+	return events, false
+}
+
+// ringsSince returns the events from the rings, ok is false when some of
+// them are no longer buffered
+func (h *history) ringsSince(match func(topic string) bool, after uint64, upto uint64) (events []historyEvent, ok bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.size == 0 || after < h.base || after < h.dropped {
+		return nil, false
+	}
+
+	for name, r := range h.topics {
+		if !match(name) {
+			continue
+		}
+		if r.evicted > after {
+			return nil, false
+		}
+		events = r.since(after, upto, events)
+	}
+
+	// an event published on several of the matching topics is replayed once
+	sort.Slice(events, func(i, j int) bool {
+		if events[i].seq != events[j].seq {
+			return events[i].seq < events[j].seq
+		}
+		return events[i].topic < events[j].topic
+	})
+	events = slices.CompactFunc(events, func(a, b historyEvent) bool { return a.seq == b.seq })
+
+	return events, true
+}
@@ -0,0 +1,214 @@
+package pubsub
+
+import (
+	"errors"
+	"maps"
+	"sort"
+)
+
+// Limits of the metadata a subscriber attaches to its presence
+const (
+	maxPresenceFields = 16
+	maxPresenceBytes  = 1024
+)
+
+var (
+	ErrPresenceTooLarge = errors.New("presence metadata too large")
+	ErrNotSubscribed    = errors.New("not subscribed")
+)
+
+// topicPresence tracks the subscriptions of one topic or topic pattern and
+// the subscriber ids behind them
+type topicPresence struct {
+	subscriptions map[*Subscription]struct{}
+	members       map[string]*member
+}
+
+// member is a subscriber id present on a topic, possibly with several
+// connections
+type member struct {
+	connections int
+	meta        map[string]string
+}
+
+// Presence is a subscriber present on a topic
+type Presence struct {
+	Id   string            `json:"id"`
+	Meta map[string]string `json:"meta,omitempty"`
+}
+
+// ValidatePresence checks the size of presence metadata
+func ValidatePresence(meta map[string]string) error {
+	if len(meta) > maxPresenceFields {
+		return ErrPresenceTooLarge
+	}
+
+	size := 0
+	for key, value := range meta {
+		size += len(key) + len(value)
+	}
+	if size > maxPresenceBytes {
+		return ErrPresenceTooLarge
+	}
+
+	return nil
+}
+
+// joinPresence adds a subscription to the presence of its topic, the other
+// subscribers learn about a subscriber id the first time it shows up or when
+// its metadata changes. s.mu has to be held.
+func (s *SubscriptionManager) joinPresence(subscription *Subscription) {
+	id := subscription.Subscriber.Id
+	if id == "" {
+		return
+	}
+
+	presence, ok := s.presence[subscription.Topic]
+	if !ok {
+		presence = &topicPresence{
+			subscriptions: make(map[*Subscription]struct{}),
+			members:       make(map[string]*member),
+		}
+		s.presence[subscription.Topic] = presence
+	}
+	presence.subscriptions[subscription] = struct{}{}
+
+	m, ok := presence.members[id]
+	if !ok {
+		m = &member{}
+		presence.members[id] = m
+	}
+	m.connections++
+
+	if m.connections == 1 || (subscription.Meta != nil && !maps.Equal(m.meta, subscription.Meta)) {
+		if subscription.Meta != nil {
+			m.meta = subscription.Meta
+		}
+		s.announce(presence, Frame{Type: FrameJoin, Topic: subscription.Topic, Subscriber: id, Data: m.meta})
+	}
+
+	// a new subscription learns who is already there
+	if subscription.Presence {
+		for other, m := range presence.members {
+			if other != id {
+				subscription.Subscriber.SendFrame(Frame{Type: FrameJoin, Topic: subscription.Topic, Subscriber: other, Data: m.meta})
+			}
+		}
+	}
+}
+
+// leavePresence removes a subscription from the presence of its topic, the
+// other subscribers are told once the last connection of a subscriber id is
+// gone. s.mu has to be held.
+func (s *SubscriptionManager) leavePresence(subscription *Subscription) {
+	presence, ok := s.presence[subscription.Topic]
+	if !ok {
+		return
+	}
+	if _, ok := presence.subscriptions[subscription]; !ok {
+		return
+	}
+	delete(presence.subscriptions, subscription)
+
+	id := subscription.Subscriber.Id
+	m := presence.members[id]
+	m.connections--
+	if m.connections == 0 {
+		delete(presence.members, id)
+		s.announce(presence, Frame{Type: FrameLeave, Topic: subscription.Topic, Subscriber: id})
+	}
+
+	if len(presence.subscriptions) == 0 {
+		delete(s.presence, subscription.Topic)
+	}
+}
+
+// announce sends a join or leave frame to the subscriptions of a topic that
+// asked for them, except those of the subscriber it is about
+func (s *SubscriptionManager) announce(presence *topicPresence, frame Frame) {
+	for subscription := range presence.subscriptions {
+		if !subscription.Presence || subscription.Subscriber.Id == frame.Subscriber {
+			continue
+		}
+
+		subscription.Subscriber.SendFrame(frame)
+	}
+}
+
+// SetPresence replaces the metadata the subscriber shows on a topic it is
+// subscribed to
+func (s *SubscriptionManager) SetPresence(sub *Subscriber, topic string, meta map[string]string) error {
+	if err := ValidatePresence(meta); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	subscription, ok := sub.subscriptions[topic]
+	if !ok {
+		return ErrNotSubscribed
+	}
+
+	subscription.Meta = meta
+
+	// subscribers without an id are not tracked
+	if sub.Id == "" {
+		return nil
+	}
+
+	presence, ok := s.presence[topic]
+	if !ok {
+		return nil
+	}
+
+	m, ok := presence.members[sub.Id]
+	if !ok {
+		return nil
+	}
+	if !maps.Equal(m.meta, meta) {
+		m.meta = meta
+		s.announce(presence, Frame{Type: FrameJoin, Topic: topic, Subscriber: sub.Id, Data: meta})
+	}
+
+	return nil
+}
+
+// Presence lists the subscribers present on a topic, by id
+func (s *SubscriptionManager) Presence(topic string) []Presence {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	presence, ok := s.presence[topic]
+	if !ok {
+		return []Presence{}
+	}
+
+	return presence.list()
+}
+
+// AllPresence lists the subscribers present on every topic allowed with the
+// claims of the caller's token
+func (s *SubscriptionManager) AllPresence(claims []string) map[string][]Presence {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	all := make(map[string][]Presence, len(s.presence))
+	for topic, presence := range s.presence {
+		if s.Allowed(claims, topic) {
+			all[topic] = presence.list()
+		}
+	}
+
+	return all
+}
+
+func (p *topicPresence) list() []Presence {
+	list := make([]Presence, 0, len(p.members))
+	for id, m := range p.members {
+		list = append(list, Presence{Id: id, Meta: m.meta})
+	}
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Id < list[j].Id })
+	return list
+}
@@ -0,0 +1,62 @@
+package pubsub
+
+import (
+	"encoding/json"
+	"realtimer/internal/config"
+	"testing"
+)
+
+// newTestSubscriber is a subscriber without a connection, its frames stay in
+// its queue
+func newTestSubscriber(s *SubscriptionManager, id string) *Subscriber {
+	return &Subscriber{
+		Id:      id,
+		queue:   make(chan []byte, s.queueSize),
+		manager: s,
+		member:  s.members.Add(1),
+	}
+}
+
+// frames takes the frames queued for a subscriber
+func frames(t *testing.T, sub *Subscriber) []Frame {
+	t.Helper()
+
+	var frames []Frame
+	for len(sub.queue) > 0 {
+		var frame Frame
+		if err := json.Unmarshal(<-sub.queue, &frame); err != nil {
+			t.Fatal(err)
+		}
+		frames = append(frames, frame)
+	}
+
+	return frames
+}
+
+func TestSetPresenceAnonymous(t *testing.T) {
+	s, err := NewSubscriptionManager(config.DBConfig{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const topic = "broadcast:room"
+	member := newTestSubscriber(s, "alice")
+	s.Subscribe(&Subscription{Topic: topic, Subscriber: member, Presence: true})
+
+	anonymous := newTestSubscriber(s, "")
+	s.Subscribe(&Subscription{Topic: topic, Subscriber: anonymous, Presence: true})
+	frames(t, member)
+
+	if err := s.SetPresence(anonymous, topic, map[string]string{"status": "away"}); err != nil {
+		t.Fatalf("SetPresence: %v", err)
+	}
+
+	if got := frames(t, member); len(got) != 0 {
+		t.Errorf("frames sent about the anonymous subscriber: %v", got)
+	}
+
+	want := []Presence{{Id: "alice"}}
+	if got := s.Presence(topic); len(got) != 1 || got[0].Id != want[0].Id {
+		t.Errorf("Presence(%s) = %v, want %v", topic, got, want)
+	}
+}
@@ -0,0 +1,84 @@
+package pubsub
+
+import (
+	"encoding/json"
+	"slices"
+	"strings"
+)
+
+// shapeOf returns the key under which events projected to fields are
+// encoded, the same for every order of the same fields
+func shapeOf(fields []string) string {
+	if len(fields) == 0 {
+		return ""
+	}
+
+	sorted := slices.Clone(fields)
+	slices.Sort(sorted)
+	return strings.Join(slices.Compact(sorted), "\x00")
+}
+
+// project returns the fields of a row, fields missing in the row are left out
+func project(message map[string]string, fields []string) map[string]string {
+	if len(fields) == 0 {
+		return message
+	}
+
+	projected := make(map[string]string, len(fields))
+	for _, field := range fields {
+		if value, ok := message[field]; ok {
+			projected[field] = value
+		}
+	}
+
+	return projected
+}
+
+// encoder encodes an event for its subscribers, once for every projection
+// and for raw subscribers, however many subscribers share it
+type encoder struct {
+	topic   string
+	seq     uint64
+	message map[string]string
+
+	frames map[string][]byte // by shape
+	raws   map[string][]byte // by shape
+}
+
+func newEncoder(topic string, seq uint64, message map[string]string, frame []byte) *encoder {
+	return &encoder{
+		topic:   topic,
+		seq:     seq,
+		message: message,
+		frames:  map[string][]byte{"": frame},
+		raws:    make(map[string][]byte),
+	}
+}
+
+// encode returns the data sent to the subscriber of a subscription
+func (e *encoder) encode(subscription *Subscription) ([]byte, error) {
+	cache := e.frames
+	if subscription.Raw {
+		cache = e.raws
+	}
+
+	if data, ok := cache[subscription.shape]; ok {
+		return data, nil
+	}
+
+	message := project(e.message, subscription.Fields)
+
+	var data []byte
+	var err error
+	if subscription.Raw {
+		data, err = json.Marshal(message)
+	} else {
+		data, err = json.Marshal(Frame{Type: FrameEvent, Topic: e.topic, Seq: e.seq, Data: message})
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	cache[subscription.shape] = data
+	return data, nil
+}
@@ -0,0 +1,83 @@
+package pubsub
+
+// Frame types of the WebSocket control protocol. Clients send subscribe,
+// unsubscribe and ping requests, each answered with an ack, pong or error
+// frame carrying the id of the request. Published rows are delivered in
+// event frames numbered with a sequence id, a subscribe can resume from the
+// last id a client received and gets a resync frame when events were lost.
+// Events of durable subscriptions are confirmed with ack requests and sent
+// again until they are. Subscribers asking for presence get join and leave
+// frames when other subscriber ids come and go on the topic. Publish requests
+// send a message to the subscribers of a broadcast channel. Subscribing to a
+// live query topic sends its result, then diffs of it.
+const (
+	FrameSubscribe   = "subscribe"
+	FramePublish     = "publish"
+	FrameUnsubscribe = "unsubscribe"
+	FramePing        = "ping"
+	FramePong        = "pong"
+	FrameAck         = "ack"
+	FrameError       = "error"
+	FrameEvent       = "event"
+	FrameResync      = "resync"
+	FramePresence    = "presence"
+	FrameJoin        = "join"
+	FrameLeave       = "leave"
+	FrameResult      = "result"
+	FrameDiff        = "diff"
+)
+
+// QueryPrefix starts the topics of live queries, query:<name>:<values> with
+// the query escaped parameter values separated by ','
+const QueryPrefix = "query:"
+
+// Request is a message sent by a client
+type Request struct {
+	Type  string `json:"type"`
+	Id    string `json:"id,omitempty"`
+	Topic string `json:"topic,omitempty"`
+	// Key scopes the topic to the row with these primary key values
+	Key map[string]string `json:"key,omitempty"`
+	// Filter restricts a subscription to the rows it matches
+	Filter *Filter `json:"filter,omitempty"`
+	// ResumeFrom replays the events published after this sequence id
+	ResumeFrom *uint64 `json:"resume_from,omitempty"`
+	// Fields projects the rows sent to these fields
+	Fields []string `json:"fields,omitempty"`
+	// Coalesce is a window like "500ms" over which the events of each row
+	// are merged into the latest version
+	Coalesce string `json:"coalesce,omitempty"`
+	// Group joins a consumer group sharing the topic's events
+	Group string `json:"group,omitempty"`
+	// Durable keeps the subscription's position under the subscriber id
+	Durable bool `json:"durable,omitempty"`
+	// Presence asks for the join and leave frames of the topic, Meta is the
+	// presence metadata of the subscriber, also set with a presence request
+	Presence bool              `json:"presence,omitempty"`
+	Meta     map[string]string `json:"meta,omitempty"`
+	// Params fill the parameters of a live query
+	Params map[string]string `json:"params,omitempty"`
+	// Data is the message of a publish request
+	Data map[string]string `json:"data,omitempty"`
+	// Seq is the sequence id acknowledged by an ack request
+	Seq uint64 `json:"seq,omitempty"`
+}
+
+// Frame is a message sent to a client
+type Frame struct {
+	Type  string            `json:"type"`
+	Id    string            `json:"id,omitempty"`
+	Topic string            `json:"topic,omitempty"`
+	Seq   uint64            `json:"seq,omitempty"`
+	Data  map[string]string `json:"data,omitempty"`
+	Error string            `json:"error,omitempty"`
+	// Subscriber is the id a join or leave frame is about, or the sender of
+	// a broadcast message
+	Subscriber string `json:"subscriber,omitempty"`
+	// Rows is the result of a live query, the diffs after it are Added,
+	// Removed and Changed rows
+	Rows    []map[string]string `json:"rows,omitempty"`
+	Added   []map[string]string `json:"added,omitempty"`
+	Removed []map[string]string `json:"removed,omitempty"`
+	Changed []map[string]string `json:"changed,omitempty"`
+}
@@ -2,65 +2,570 @@ package pubsub
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"realtimer/internal/config"
+	"realtimer/internal/eventlog"
+	"strings"
 	"sync"
-
-	"github.com/gofiber/contrib/websocket"
+	"sync/atomic"
+	"time"
 )
 
-type Subscriber struct {
-	Conn *websocket.Conn
-	Id   string
+// Subscription is the interest of a subscriber in a topic or topic pattern
+type Subscription struct {
+	Topic      string
+	Subscriber *Subscriber
+	// Filter, when set, has to match a row for it to be sent
+	Filter *Filter
+	// Group, when set, shares the topic's events between the subscriptions
+	// of the group, each row is sent to one of them
+	Group string
+	// Presence sends join and leave frames of the other subscribers of the
+	// topic, Meta is shown to them as this subscriber's presence
+	Presence bool
+	Meta     map[string]string
+	// Fields, when set, are the only fields of the rows sent
+	Fields []string
+	// Coalesce holds back the events of each row for this window and only
+	// sends the latest version
+	Coalesce time.Duration
+	// Raw sends the bare row instead of an event frame, for the subscription
+	// of a connection opened with the event and table query parameters
+	Raw bool
+
+	durable *durable         // set on durable subscriptions
+	row     *rowSubscription // set on subscriptions scoped to a row
+
+	coalescer *coalescer
+	shape     string // key of Fields for sharing encoded events
+
+	// live events are held back while the history is replayed to the
+	// subscription
+	sendMu    sync.Mutex
+	replaying bool
+	held      [][]byte
 }
 
 type SubscriptionManager struct {
-	subscribers map[string][]Subscriber // map of topic to slice of WebSocket connections
-	mu          sync.RWMutex            // to handle concurrent access
+	subscribers map[string][]*Subscription   // map of topic to slice of WebSocket connections
+	patterns    *topicNode                   // wildcard subscriptions
+	rows        map[rowIndex][]*Subscription // subscriptions scoped to a row
+	connected   map[*Subscriber]struct{}     // every open connection
+	history     *history                     // recent events for resuming subscribers
+	mu          sync.RWMutex                 // to handle concurrent access
+	order       sync.Mutex                   // events are numbered and queued in the same order
+	delivered   atomic.Uint64                // seq of the last event being delivered, set under mu
+
+	queueSize int
+	overflow  string
+	dropped   atomic.Uint64
+
+	durables       map[durableKey]*durable // durable subscriptions, also while their subscriber is away
+	store          *eventlog.Log
+	cursorsChanged bool // the positions of durable subscriptions have to be stored
+	ackTimeout     time.Duration
+	maxUnacked     int
+
+	primaryKeys map[string][]string // table to primary key columns, for consumer groups
+	members     atomic.Uint64       // last member id given to a subscriber
+
+	presence map[string]*topicPresence // subscriber ids present on each topic
+
+	broadcastRate  float64
+	broadcastBurst int
+
+	watchers []func(topic string, message map[string]string)
+
+	coalescers map[string]*coalescer // of tables coalescing their events
+
+	stages []Expander
+
+	routes    map[string][]route // of tables routing their events
+	routeList []route            // every route, in the order of the config
+}
+
+// Stage prepares an event before it is published, it returns the message to
+// publish or nil to drop the event
+type Stage func(topic string, message map[string]string) map[string]string
+
+// Expander is a stage turning an event into any number of events, of any
+// topics
+type Expander func(topic string, message map[string]string) []Event
+
+// Event is a message published on a topic
+type Event struct {
+	Topic string            `json:"topic"`
+	Data  map[string]string `json:"data"`
+}
+
+// Stats are counters of the subscription manager
+type Stats struct {
+	Subscribers int    `json:"subscribers"`
+	Dropped     uint64 `json:"dropped"`
+	// DroppedBySubscriber only lists subscribers that lost messages
+	DroppedBySubscriber map[string]uint64 `json:"dropped_by_subscriber"`
+	// Groups is the number of members of each consumer group, by
+	// "<group> <topic>", of the topics allowed to the caller
+	Groups map[string]int `json:"groups"`
+}
+
+func NewSubscriptionManager(cfg config.DBConfig, eventLog *eventlog.Log) (*SubscriptionManager, error) {
+	routes, err := parseRoutes(cfg.Tables)
+	if err != nil {
+		return nil, err
+	}
+
+	queueSize := cfg.Pubsub.QueueSize
+	if queueSize <= 0 {
+		queueSize = defaultQueueSize
+	}
+
+	overflow := cfg.Pubsub.Overflow
+	if overflow == "" {
+		overflow = OverflowDropOldest
+	}
+
+	replaySize := cfg.Pubsub.ReplaySize
+	if replaySize == 0 {
+		replaySize = defaultReplaySize
+	} else if replaySize < 0 {
+		replaySize = 0
+	}
+
+	ackTimeout := cfg.Pubsub.AckTimeout
+	if ackTimeout <= 0 {
+		ackTimeout = defaultAckTimeout
+	}
+
+	maxUnacked := cfg.Pubsub.MaxUnacked
+	if maxUnacked <= 0 {
+		maxUnacked = defaultMaxUnacked
+	}
+
+	broadcastRate := cfg.Pubsub.BroadcastRate
+	if broadcastRate <= 0 {
+		broadcastRate = defaultBroadcastRate
+	}
+
+	broadcastBurst := cfg.Pubsub.BroadcastBurst
+	if broadcastBurst <= 0 {
+		broadcastBurst = max(1, int(broadcastRate))
+	}
+
+	s := &SubscriptionManager{
+		subscribers: make(map[string][]*Subscription),
+		patterns:    newTopicNode(),
+		rows:        make(map[rowIndex][]*Subscription),
+		connected:   make(map[*Subscriber]struct{}),
+		history:     newHistory(replaySize, eventLog),
+		queueSize:   queueSize,
+		overflow:    overflow,
+		durables:    make(map[durableKey]*durable),
+		store:       eventLog,
+		ackTimeout:  ackTimeout,
+		maxUnacked:  maxUnacked,
+		primaryKeys: primaryKeys(cfg.Tables),
+		presence:    make(map[string]*topicPresence),
+		routes:      routes,
+
+		broadcastRate:  broadcastRate,
+		broadcastBurst: broadcastBurst,
+	}
+
+	for _, table := range cfg.Tables {
+		s.routeList = append(s.routeList, routes[table.Name]...)
+	}
+
+	s.coalescers = make(map[string]*coalescer)
+	for _, table := range cfg.Tables {
+		if table.Coalesce > 0 {
+			s.coalescers[table.Name] = newCoalescer(table.Coalesce, func(event *coalescedEvent) {
+				s.publish(event.topic(), event.message)
+			})
+		}
+	}
+
+	// the events of the log were delivered before a restart
+	s.delivered.Store(s.history.last())
+	s.loadCursors()
+	go s.redeliverLoop()
+
+	return s, nil
 }
 
-func NewSubscriptionManager() *SubscriptionManager {
-	return &SubscriptionManager{
-		subscribers: make(map[string][]Subscriber),
+// Stats returns the counters, with the groups of the topics allowed with the
+// claims of the caller's token
+func (s *SubscriptionManager) Stats(claims []string) Stats {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	stats := Stats{
+		Subscribers:         len(s.connected),
+		Dropped:             s.dropped.Load(),
+		DroppedBySubscriber: make(map[string]uint64),
+		Groups:              make(map[string]int),
+	}
+	for sub := range s.connected {
+		if dropped := sub.Dropped(); dropped > 0 {
+			stats.DroppedBySubscriber[sub.Id] += dropped
+		}
+		for _, subscription := range sub.subscriptions {
+			if subscription.Group != "" && s.Allowed(claims, subscription.Topic) {
+				stats.Groups[subscription.Group+" "+subscription.Topic]++
+			}
+		}
 	}
+
+	return stats
+}
+
+// Use adds a stage every published event goes through, in the order they
+// were added
+func (s *SubscriptionManager) Use(stage Stage) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.stages = append(s.stages, func(topic string, message map[string]string) []Event {
+		if message = stage(topic, message); message == nil {
+			return nil
+		}
+		return []Event{{Topic: topic, Data: message}}
+	})
+}
+
+// UseExpander adds a stage that can replace an event with several ones or
+// none, the following stages see each of them
+func (s *SubscriptionManager) UseExpander(stage Expander) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.stages = append(s.stages, stage)
 }
 
-func (s *SubscriptionManager) Subscribe(topic string, sub Subscriber) {
+// Watch registers a function called with every published event. It must not
+// block or call back into the manager.
+func (s *SubscriptionManager) Watch(watcher func(topic string, message map[string]string)) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	s.watchers = append(s.watchers, watcher)
+}
+
+// Subscribe adds a subscription, replacing the one its subscriber already had
+// for the same topic or topic pattern
+func (s *SubscriptionManager) Subscribe(subscription *Subscription) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.subscribeLocked(subscription)
+}
+
+// SubscribeFrom adds a subscription after sending it the buffered events
+// published since the given sequence id. When some of them are no longer
+// buffered nothing is replayed and a resync frame tells the client to reload
+// its state instead.
+func (s *SubscriptionManager) SubscribeFrom(subscription *Subscription, after uint64, requestId string) {
+	// the subscription holds back the events published from now on, the
+	// ones before are read and sent without blocking publishing
+	s.mu.Lock()
+	subscription.replaying = true
+	s.subscribeLocked(subscription)
+	upto := s.delivered.Load()
+	s.mu.Unlock()
+
+	events, gap := s.history.since(subscription.matchTopic, after, upto)
+	if gap {
+		subscription.Subscriber.SendFrame(Frame{Type: FrameResync, Id: requestId, Topic: subscription.Topic})
+	} else {
+		for _, event := range events {
+			if s.matchRow(subscription, event.topic, event.message) && subscription.Filter.Match(event.message) {
+				subscription.Subscriber.Send(event.encode(subscription))
+			}
+		}
+	}
+
+	subscription.endReplay()
+}
+
+// send queues an event for the subscriber, or holds it back while the
+// history is replayed to the subscription
+func (subscription *Subscription) send(data []byte) error {
+	subscription.sendMu.Lock()
+	defer subscription.sendMu.Unlock()
+
+	if subscription.replaying {
+		subscription.held = append(subscription.held, data)
+		return nil
+	}
+
+	return subscription.Subscriber.Send(data)
+}
+
+// endReplay sends the events held back during the replay and the following
+// ones right away
+func (subscription *Subscription) endReplay() {
+	subscription.sendMu.Lock()
+	defer subscription.sendMu.Unlock()
+
+	for _, data := range subscription.held {
+		subscription.Subscriber.Send(data)
+	}
+	subscription.held = nil
+	subscription.replaying = false
+}
+
+func (subscription *Subscription) isReplaying() bool {
+	subscription.sendMu.Lock()
+	defer subscription.sendMu.Unlock()
+
+	return subscription.replaying
+}
+
+func (s *SubscriptionManager) subscribeLocked(subscription *Subscription) {
+	sub := subscription.Subscriber
+	if sub.subscriptions == nil {
+		sub.subscriptions = make(map[string]*Subscription)
+	}
+	// joining before the old subscription leaves keeps the subscriber
+	// present throughout
+	s.joinPresence(subscription)
+	if existing, ok := sub.subscriptions[subscription.Topic]; ok {
+		s.removeSubscription(existing)
+	}
+
 	// Add the client to the list of subscribers for the topic
-	s.subscribers[topic] = append(s.subscribers[topic], sub)
+	sub.subscriptions[subscription.Topic] = subscription
+	subscription.row = rowSubscriptionOf(subscription.Topic)
+	subscription.shape = shapeOf(subscription.Fields)
+	if subscription.Coalesce > 0 {
+		subscription.coalescer = newCoalescer(subscription.Coalesce, subscription.sendCoalesced)
+	}
+	if subscription.row != nil {
+		s.addRowSubscription(subscription)
+	} else if IsPattern(subscription.Topic) {
+		s.patterns.insert(subscription.Topic, subscription)
+	} else {
+		s.subscribers[subscription.Topic] = append(s.subscribers[subscription.Topic], subscription)
+	}
 }
 
-func (s *SubscriptionManager) Unsubscribe(topic string, sub Subscriber) {
+// Unsubscribe removes the subscriber from a topic, it returns false when the
+// subscriber was not subscribed
+func (s *SubscriptionManager) Unsubscribe(topic string, sub *Subscriber) bool {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	subscription, ok := sub.subscriptions[topic]
+	if !ok {
+		return false
+	}
+
+	delete(sub.subscriptions, topic)
+	s.removeSubscription(subscription)
+	s.dropDurable(subscription)
+	return true
+}
+
+func (s *SubscriptionManager) removeSubscription(subscription *Subscription) {
+	if subscription.durable != nil {
+		subscription.durable.detach(subscription)
+	}
+	s.leavePresence(subscription)
+	if subscription.coalescer != nil {
+		subscription.coalescer.stop()
+	}
+
+	topic := subscription.Topic
+	if subscription.row != nil {
+		s.removeRowSubscription(subscription)
+		return
+	}
+	if IsPattern(topic) {
+		s.patterns.remove(topic, subscription)
+		return
+	}
+
 	// Remove the client from the list of subscribers for the topic
-	for i, c := range s.subscribers[topic] {
-		if c == sub {
-			s.subscribers[topic] = append(s.subscribers[topic][:i], s.subscribers[topic][i+1:]...)
-			break
-		}
+	subscriptions := removeFrom(s.subscribers[topic], subscription)
+	if len(subscriptions) == 0 {
+		delete(s.subscribers, topic)
+	} else {
+		s.subscribers[topic] = subscriptions
 	}
 }
 
+// Publish sends an event to the subscribers of its topic, or of the topics
+// its table routes it to. The event goes through the stages first, rows of
+// tables that coalesce their events are then held back for the table's window.
 func (s *SubscriptionManager) Publish(topic string, message map[string]string) {
 	s.mu.RLock()
-	defer s.mu.RUnlock()
+	stages := s.stages
+	s.mu.RUnlock()
+
+	events := []Event{{Topic: topic, Data: message}}
+	for _, stage := range stages {
+		var next []Event
+		for _, event := range events {
+			next = append(next, stage(event.Topic, event.Data)...)
+		}
+		events = next
+	}
+
+	for _, event := range events {
+		if c, ok := s.coalescers[topicTable(event.Topic)]; ok && isRowEvent(event.Topic) {
+			// rows without their key cannot be told apart, they are not
+			// held back
+			if key, keyed := s.rowKey(event.Topic, event.Data); keyed {
+				c.add(key, event.Topic, 0, event.Data, nil)
+				continue
+			}
+		}
+
+		s.publish(event.Topic, event.Data)
+	}
+}
+
+func (s *SubscriptionManager) publish(topic string, message map[string]string) {
+	// watchers see the event on its table's topic, whatever its routes
+	s.mu.RLock()
+	for _, watcher := range s.watchers {
+		watcher(topic, message)
+	}
+	s.mu.RUnlock()
+
+	topics := s.topics(topic, message)
+	if len(topics) == 0 {
+		return
+	}
 
-	// Convert map to JSON
-	jsonData, err := json.Marshal(message)
+	s.order.Lock()
+	defer s.order.Unlock()
+
+	// The event is numbered once and its frame encoded once per routed
+	// topic for all subscribers, and kept for replay even when nobody
+	// listens right now. Writing it to the event log only holds up the
+	// other publishes, not the subscriptions.
+	seq, frames, err := s.history.append(topics, message, func(seq uint64, topic string) ([]byte, error) {
+		return json.Marshal(Frame{Type: FrameEvent, Topic: topic, Seq: seq, Data: message})
+	})
 	if err != nil {
 		fmt.Println("Error converting map to JSON:", err)
 		return
 	}
 
-	// Send the message to all clients subscribed to this topic
-	for _, sub := range s.subscribers[topic] {
-		if err := sub.Conn.WriteMessage(websocket.TextMessage, jsonData); err != nil {
-			log.Printf("error writing message to topic %s: %v", topic, err)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	// subscriptions added from now on get the event live, the replay of
+	// the history stops before it
+	s.delivered.Store(seq)
+
+	key, keyed := s.rowKey(topic, message)
+
+	// A subscriber matching the event through several subscriptions or
+	// routed topics still gets it once
+	var deliveries []delivery
+	seen := make(map[*Subscriber]struct{})
+	matched := make(map[*Subscription]struct{})
+	// Members of a consumer group are collected first, the row goes to one
+	// of them picked by its primary key
+	var groups map[groupKey][]delivery
+
+	for i, routed := range topics {
+		// Every projection of the event is encoded once, however many
+		// subscriptions share it
+		enc := newEncoder(routed, seq, message, frames[i])
+		deliver := func(subscription *Subscription) {
+			if _, ok := matched[subscription]; ok {
+				return
+			}
+			matched[subscription] = struct{}{}
+
+			if !subscription.Filter.Match(message) {
+				return
+			}
+			d := delivery{subscription: subscription, enc: enc}
+			// durable subscriptions keep the event until it is
+			// acknowledged, even when the subscriber already gets it
+			// through another one
+			if subscription.durable != nil && !subscription.durable.track(seq, d.encode(), s.maxUnacked) {
+				log.Printf("disconnecting subscriber %s, too many unacknowledged events on %s", subscription.Subscriber.Id, subscription.Topic)
+				subscription.Subscriber.disconnect()
+				return
+			}
+			if subscription.coalescer != nil && keyed && isRowEvent(routed) {
+				subscription.coalescer.add(key, routed, seq, message, d.encode())
+				return
+			}
+			if subscription.Group != "" {
+				if groups == nil {
+					groups = make(map[groupKey][]delivery)
+				}
+				key := groupKey{group: subscription.Group, topic: subscription.Topic}
+				groups[key] = append(groups[key], d)
+				return
+			}
+			if _, ok := seen[subscription.Subscriber]; ok {
+				return
+			}
+
+			seen[subscription.Subscriber] = struct{}{}
+			deliveries = append(deliveries, d)
+		}
+
+		for _, subscription := range s.subscribers[routed] {
+			deliver(subscription)
+		}
+		s.patterns.match(routed, deliver)
+
+		if len(s.rows) > 0 && keyed {
+			event, table, _ := strings.Cut(routed, ":")
+			for _, subscription := range s.rows[rowIndex{table: table, key: key}] {
+				if subscription.row.event == "*" || subscription.row.event == event {
+					deliver(subscription)
+				}
+			}
+		}
+	}
+
+	if len(groups) > 0 {
+		for _, members := range groups {
+			member := pickMember(members, key)
+			if _, ok := seen[member.subscription.Subscriber]; ok {
+				continue
+			}
+
+			seen[member.subscription.Subscriber] = struct{}{}
+			deliveries = append(deliveries, member)
 		}
 	}
+
+	// Send the message to all clients subscribed to its topics
+	for _, d := range deliveries {
+		data := d.encode()
+		if data == nil {
+			continue
+		}
+
+		if err := d.subscription.send(data); err != nil && !errors.Is(err, ErrSubscriberClosed) {
+			log.Printf("error writing message to topic %s: %v", d.enc.topic, err)
+		}
+	}
+}
+
+// delivery is a subscription an event goes to, with the encoder of the
+// routed topic it matched
+type delivery struct {
+	subscription *Subscription
+	enc          *encoder
+}
+
+func (d delivery) encode() []byte {
+	data, err := d.enc.encode(d.subscription)
+	if err != nil {
+		log.Printf("error encoding event of topic %s: %v", d.enc.topic, err)
+	}
+	return data
 }
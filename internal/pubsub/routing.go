@@ -0,0 +1,284 @@
+package pubsub
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"realtimer/internal/config"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// Routes derive the topics of a table's events from the event, the table and
+// the row, e.g. "{event}:orders.tenant-{tenant_id}". Events of tables without
+// routes are published on <event>:<table>, or on <event>:<public name> and
+// <event>:<alias> when the table has a public name or aliases, so clients
+// never depend on the name of the table in the database.
+
+var ErrInvalidRoute = errors.New("invalid route")
+
+// route is a parsed routing template, fields are the placeholders between
+// the literal parts
+type route struct {
+	literals []string // one more than fields
+	fields   []string
+	table    string // public name of the table
+	source   string // name of the table in the database
+	// segments match the segments of the topics the route renders
+	segments []routeSegment
+	// restricted is true when the topics depend on fields of the row, only
+	// tokens claiming them can subscribe to them
+	restricted bool
+}
+
+// routeSegment matches a segment of the topics of a route, placeholders
+// match any value
+type routeSegment struct {
+	separator string
+	value     *regexp.Regexp
+}
+
+// EventTopic returns the topic of an event of a table before routing
+func EventTopic(event string, table string) string {
+	return strings.ToLower(event) + ":" + table
+}
+
+// parseRoute reads a routing template, {event} and {table} stand for the
+// event and the public name of the table, any other {name} for the value of
+// that field
+func parseRoute(template string) (route, error) {
+	var r route
+	rest := template
+	for {
+		literal, after, found := strings.Cut(rest, "{")
+		if strings.ContainsAny(literal, "}*") {
+			return route{}, fmt.Errorf("%w %q", ErrInvalidRoute, template)
+		}
+		r.literals = append(r.literals, literal)
+		if !found {
+			break
+		}
+
+		field, after, found := strings.Cut(after, "}")
+		if !found || field == "" || strings.Contains(field, "{") {
+			return route{}, fmt.Errorf("%w %q", ErrInvalidRoute, template)
+		}
+		r.fields = append(r.fields, field)
+		rest = after
+	}
+
+	if strings.HasPrefix(r.literals[0], BroadcastPrefix) || strings.HasPrefix(r.literals[0], QueryPrefix) {
+		return route{}, fmt.Errorf("%w %q: reserved topic", ErrInvalidRoute, template)
+	}
+
+	// values are escaped, only the literals can add a ':', a second one
+	// would make the topics look like row topics
+	if strings.Count(strings.Join(r.literals, ""), ":") > 1 {
+		return route{}, fmt.Errorf("%w %q: a route has at most one ':'", ErrInvalidRoute, template)
+	}
+
+	for _, field := range r.fields {
+		if field != "event" && field != "table" {
+			r.restricted = true
+		}
+	}
+
+	return r, nil
+}
+
+// compile builds the segments of the route once its table is known
+func (r *route) compile() {
+	var pattern strings.Builder
+	separator := ""
+	flush := func() {
+		r.segments = append(r.segments, routeSegment{
+			separator: separator,
+			value:     regexp.MustCompile("^" + pattern.String() + "$"),
+		})
+		pattern.Reset()
+	}
+
+	literal := func(text string) {
+		for _, c := range text {
+			if c == ':' || c == '.' {
+				flush()
+				separator = string(c)
+				continue
+			}
+			pattern.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+
+	for i, field := range r.fields {
+		literal(r.literals[i])
+		if field == "table" {
+			literal(r.table)
+		} else {
+			pattern.WriteString("[^:.]+")
+		}
+	}
+	literal(r.literals[len(r.fields)])
+	flush()
+}
+
+// reaches reports whether a topic or pattern, split into segments, matches
+// topics of the route from its segment first on
+func (r route) reaches(segments []string, first int) bool {
+	for i, segment := range segments {
+		if first+i >= len(r.segments) {
+			return false
+		}
+
+		rs := r.segments[first+i]
+		if separator(segment) != rs.separator {
+			return false
+		}
+		if isWildcard(segment) {
+			if i == len(segments)-1 {
+				return true
+			}
+			continue
+		}
+		if !rs.value.MatchString(segment[len(rs.separator):]) {
+			return false
+		}
+	}
+
+	return first+len(segments) == len(r.segments)
+}
+
+// names reports whether a table name of a topic, the part after its event,
+// is one the route renders
+func (r route) names(name string) bool {
+	for i, rs := range r.segments {
+		if rs.separator == ":" {
+			return r.reaches(splitTopic("event:" + name)[1:], i)
+		}
+	}
+
+	return false
+}
+
+// parseRoutes reads the routes of the configured tables. Tables with a
+// public name or aliases are routed to them when they have no routes.
+func parseRoutes(tables config.Tables) (map[string][]route, error) {
+	names := make(map[string]string) // public names and aliases to their table
+	for _, table := range tables {
+		names[table.Name] = table.Name
+	}
+	for _, table := range tables {
+		for _, name := range publicNames(table) {
+			if strings.ContainsAny(name, ":{}*") || name == "" {
+				return nil, fmt.Errorf("table %s: invalid public name %q", table.Name, name)
+			}
+			if other, ok := names[name]; ok && other != table.Name {
+				return nil, fmt.Errorf("table %s: public name %s is taken by table %s", table.Name, name, other)
+			}
+			names[name] = table.Name
+		}
+	}
+
+	routes := make(map[string][]route)
+	for _, table := range tables {
+		templates := table.Routes
+		if len(templates) == 0 && (table.Public != "" || len(table.Aliases) > 0) {
+			for _, name := range publicNames(table) {
+				templates = append(templates, "{event}:"+name)
+			}
+		}
+
+		for _, template := range templates {
+			r, err := parseRoute(template)
+			if err != nil {
+				return nil, fmt.Errorf("table %s: %w", table.Name, err)
+			}
+			r.table = publicName(table)
+			r.source = table.Name
+			r.compile()
+			routes[table.Name] = append(routes[table.Name], r)
+		}
+	}
+
+	return routes, nil
+}
+
+// publicName returns the name clients know a table by
+func publicName(table config.Table) string {
+	if table.Public != "" {
+		return table.Public
+	}
+
+	return table.Name
+}
+
+// publicNames returns the public name of a table followed by its aliases
+func publicNames(table config.Table) []string {
+	return append([]string{publicName(table)}, table.Aliases...)
+}
+
+// render returns the topic of an event on this route, ok is false when a
+// field of the route is missing or NULL in the row
+func (r route) render(event string, message map[string]string) (string, bool) {
+	var b strings.Builder
+	for i, field := range r.fields {
+		b.WriteString(r.literals[i])
+
+		var value string
+		switch field {
+		case "event":
+			value = event
+		case "table":
+			value = r.table
+		default:
+			v, ok := message[field]
+			if !ok || v == "NULL" || v == "" {
+				return "", false
+			}
+			value = escapeSegment(v)
+		}
+		b.WriteString(value)
+	}
+	b.WriteString(r.literals[len(r.fields)])
+
+	return b.String(), true
+}
+
+// escapeSegment keeps a value from adding segments or wildcards to a topic
+func escapeSegment(value string) string {
+	value = url.QueryEscape(value)
+	value = strings.ReplaceAll(value, ".", "%2E")
+	return strings.ReplaceAll(value, "*", "%2A")
+}
+
+// topics returns the topics an event published on <event>:<table> goes to.
+// Routes missing a field of the row are left out, an event none of the
+// routes of its table fit is not published.
+func (s *SubscriptionManager) topics(topic string, message map[string]string) []string {
+	event, table, found := strings.Cut(topic, ":")
+	routes, ok := s.routes[table]
+	if !found || !ok {
+		return []string{topic}
+	}
+
+	topics := make([]string, 0, len(routes))
+	for _, r := range routes {
+		if routed, ok := r.render(event, message); ok && !slices.Contains(topics, routed) {
+			topics = append(topics, routed)
+		}
+	}
+
+	return topics
+}
+
+// routedTable returns the table whose routes render a table name of a topic,
+// the part after its event
+func (s *SubscriptionManager) routedTable(name string) (string, bool) {
+	for _, r := range s.routeList {
+		if r.names(name) {
+			return r.source, true
+		}
+	}
+
+	return "", false
+}
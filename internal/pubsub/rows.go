@@ -0,0 +1,172 @@
+package pubsub
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Row topics scope a subscription to one row: <event>:<table>:<key>, where
+// key holds the values of the table's primary key columns separated by ','
+// and query escaped, e.g. "update:orders:42" or "*:order_items:42,7". The
+// event can be "*" for every event of the row. Row subscriptions are indexed
+// by table and key, a publish finds them with one lookup however many there
+// are.
+
+var ErrInvalidRowTopic = errors.New("invalid row topic")
+
+// rowIndex identifies a row of a table
+type rowIndex struct {
+	table string
+	key   string // values of the primary key columns, as built by rowKey
+}
+
+// rowSubscription is the parsed row topic of a subscription
+type rowSubscription struct {
+	index rowIndex
+	event string
+}
+
+// parseRowTopic splits a row topic, ok is false for topics that are not
+// scoped to a row
+func parseRowTopic(topic string) (event string, table string, values []string, ok bool) {
+	if strings.HasPrefix(topic, BroadcastPrefix) || strings.HasPrefix(topic, QueryPrefix) {
+		return "", "", nil, false
+	}
+
+	parts := strings.SplitN(topic, ":", 3)
+	if len(parts) != 3 {
+		return "", "", nil, false
+	}
+
+	for _, value := range strings.Split(parts[2], ",") {
+		value, err := url.QueryUnescape(value)
+		if err != nil {
+			return "", "", nil, false
+		}
+		values = append(values, value)
+	}
+
+	return parts[0], parts[1], values, true
+}
+
+// keyColumns returns the primary key columns of a table, by its name, public
+// name, alias or a name its routes render
+func (s *SubscriptionManager) keyColumns(table string) []string {
+	if columns, ok := s.primaryKeys[table]; ok {
+		return columns
+	}
+
+	// routed names have the key of the table they route
+	if source, ok := s.routedTable(table); ok {
+		if columns, ok := s.primaryKeys[source]; ok {
+			return columns
+		}
+	}
+
+	return defaultPrimaryKey
+}
+
+// ResolveTopic checks a subscription topic and scopes it to a row when key
+// maps the table's primary key columns to their values, the returned topic
+// is the one the subscription is known by
+func (s *SubscriptionManager) ResolveTopic(topic string, key map[string]string) (string, error) {
+	if strings.HasPrefix(topic, BroadcastPrefix) || strings.HasPrefix(topic, QueryPrefix) {
+		if len(key) > 0 {
+			return "", fmt.Errorf("%w: %s has no rows", ErrInvalidRowTopic, topic)
+		}
+		return topic, nil
+	}
+
+	if len(key) > 0 {
+		if strings.Count(topic, ":") != 1 {
+			return "", fmt.Errorf("%w: a key needs an <event>:<table> topic", ErrInvalidRowTopic)
+		}
+
+		columns := s.keyColumns(topicTable(topic))
+		values := make([]string, len(columns))
+		for i, column := range columns {
+			value, ok := key[column]
+			if !ok {
+				return "", fmt.Errorf("%w: key column %s is missing", ErrInvalidRowTopic, column)
+			}
+			values[i] = url.QueryEscape(value)
+		}
+		if len(key) != len(columns) {
+			return "", fmt.Errorf("%w: key has columns that are not part of the primary key", ErrInvalidRowTopic)
+		}
+
+		topic = topic + ":" + strings.Join(values, ",")
+	}
+
+	event, table, values, ok := parseRowTopic(topic)
+	if !ok {
+		if strings.Count(topic, ":") >= 2 {
+			return "", fmt.Errorf("%w: the key is not query escaped", ErrInvalidRowTopic)
+		}
+		return topic, nil
+	}
+
+	if event != "*" && IsPattern(event) {
+		return "", fmt.Errorf("%w: the event has to be a name or *", ErrInvalidRowTopic)
+	}
+	if IsPattern(table) {
+		return "", fmt.Errorf("%w: the table can not be a pattern", ErrInvalidRowTopic)
+	}
+	if columns := s.keyColumns(table); len(values) != len(columns) {
+		return "", fmt.Errorf("%w: %s has %d primary key columns", ErrInvalidRowTopic, table, len(columns))
+	}
+
+	return topic, nil
+}
+
+// rowSubscriptionOf parses the row topic of a subscription, nil when it is
+// not scoped to a row
+func rowSubscriptionOf(topic string) *rowSubscription {
+	event, table, values, ok := parseRowTopic(topic)
+	if !ok {
+		return nil
+	}
+
+	return &rowSubscription{
+		index: rowIndex{table: table, key: strings.Join(values, "\x00")},
+		event: event,
+	}
+}
+
+// matchTopic reports whether a published topic can reach the subscription,
+// for row subscriptions the row itself is checked by matchRow
+func (subscription *Subscription) matchTopic(topic string) bool {
+	if subscription.row == nil {
+		return MatchTopic(subscription.Topic, topic)
+	}
+
+	event, _, _ := strings.Cut(topic, ":")
+	return topicTable(topic) == subscription.row.index.table && (subscription.row.event == "*" || subscription.row.event == event)
+}
+
+// matchRow reports whether a published row is the row of a row subscription
+func (s *SubscriptionManager) matchRow(subscription *Subscription, topic string, message map[string]string) bool {
+	if subscription.row == nil {
+		return true
+	}
+
+	key, ok := s.rowKey(topic, message)
+	return ok && key == subscription.row.index.key
+}
+
+func (s *SubscriptionManager) addRowSubscription(subscription *Subscription) {
+	index := subscription.row.index
+	s.rows[index] = append(s.rows[index], subscription)
+}
+
+func (s *SubscriptionManager) removeRowSubscription(subscription *Subscription) {
+	index := subscription.row.index
+	subscriptions := removeFrom(s.rows[index], subscription)
+	if len(subscriptions) == 0 {
+		delete(s.rows, index)
+	} else {
+		s.rows[index] = subscriptions
+	}
+}
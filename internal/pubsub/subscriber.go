@@ -0,0 +1,217 @@
+package pubsub
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gofiber/contrib/websocket"
+)
+
+// Overflow policies, applied when a subscriber's queue is full
+const (
+	// OverflowDropOldest discards the oldest queued message to make room
+	OverflowDropOldest = "drop_oldest"
+	// OverflowDropNewest discards the message being sent
+	OverflowDropNewest = "drop_newest"
+	// OverflowDisconnect closes the connection of the slow subscriber
+	OverflowDisconnect = "disconnect"
+)
+
+const defaultQueueSize = 256
+
+var ErrSubscriberClosed = errors.New("subscriber is closed")
+
+// Subscriber is a single WebSocket connection, subscribed to any number of
+// topics. Messages are queued and written by the subscriber's own writer
+// goroutine so a slow connection never holds up a publish.
+type Subscriber struct {
+	Conn *websocket.Conn
+	Id   string
+	// Claims are the topics claimed by the token of the connection, nil
+	// without the claim
+	Claims []string
+
+	member  uint64   // unique id of the connection, for consumer groups
+	limiter *limiter // of broadcast messages
+
+	subscriptions map[string]*Subscription // topic to subscription, guarded by SubscriptionManager.mu
+
+	queue    chan []byte
+	overflow string
+	dropped  atomic.Uint64
+	manager  *SubscriptionManager
+
+	mu     sync.Mutex // guards closed and sending on queue
+	closed bool
+	done   chan struct{} // closed when the writer goroutine is done
+}
+
+// AddSubscriber registers a connection and starts its writer goroutine
+func (s *SubscriptionManager) AddSubscriber(conn *websocket.Conn, id string, claims []string) *Subscriber {
+	sub := &Subscriber{
+		Conn:     conn,
+		Id:       id,
+		Claims:   claims,
+		queue:    make(chan []byte, s.queueSize),
+		overflow: s.overflow,
+		manager:  s,
+		member:   s.members.Add(1),
+		limiter:  newLimiter(s.broadcastRate, s.broadcastBurst),
+		done:     make(chan struct{}),
+	}
+
+	s.mu.Lock()
+	s.connected[sub] = struct{}{}
+	s.mu.Unlock()
+
+	go sub.writeLoop()
+
+	return sub
+}
+
+// RemoveSubscriber drops every subscription of a closed connection and stops
+// its writer goroutine. It returns once the writer is done, the handler can
+// then return and the connection be reused.
+func (s *SubscriptionManager) RemoveSubscriber(sub *Subscriber) {
+	s.mu.Lock()
+	for _, subscription := range sub.subscriptions {
+		s.removeSubscription(subscription)
+	}
+	sub.subscriptions = nil
+	delete(s.connected, sub)
+	s.mu.Unlock()
+
+	// a write in progress fails right away instead of waiting for the client
+	sub.mu.Lock()
+	sub.disconnectLocked()
+	sub.closeLocked()
+	sub.mu.Unlock()
+
+	<-sub.done
+}
+
+func (sub *Subscriber) writeLoop() {
+	defer close(sub.done)
+
+	for data := range sub.queue {
+		// queued messages are dropped once the subscriber is closed
+		if sub.isClosed() {
+			break
+		}
+
+		if err := sub.Conn.WriteMessage(websocket.TextMessage, data); err != nil {
+			log.Printf("error writing message to subscriber %s: %v", sub.Id, err)
+			sub.disconnect()
+			break
+		}
+	}
+
+	// keep draining so senders never block on a dead connection
+	for range sub.queue {
+	}
+}
+
+func (sub *Subscriber) isClosed() bool {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+
+	return sub.closed
+}
+
+func (sub *Subscriber) closeLocked() {
+	if !sub.closed {
+		sub.closed = true
+		close(sub.queue)
+	}
+}
+
+// disconnect makes the pending read and write of the connection fail, the
+// handler's read loop then returns and the connection is closed. Closing the
+// hijacked connection directly is a no-op while the handler still runs.
+func (sub *Subscriber) disconnect() {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+
+	sub.disconnectLocked()
+}
+
+// disconnectLocked does nothing once the subscriber is closed, its
+// connection may already be released
+func (sub *Subscriber) disconnectLocked() {
+	if sub.closed {
+		return
+	}
+
+	sub.Conn.SetReadDeadline(time.Now())
+	sub.Conn.SetWriteDeadline(time.Now())
+}
+
+// Send queues a text message for the subscriber's connection, applying the
+// overflow policy when the queue is full
+func (sub *Subscriber) Send(data []byte) error {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+
+	if sub.closed {
+		return ErrSubscriberClosed
+	}
+
+	select {
+	case sub.queue <- data:
+		return nil
+	default:
+	}
+
+	switch sub.overflow {
+	case OverflowDropNewest:
+		sub.drop()
+	case OverflowDisconnect:
+		sub.drop()
+		log.Printf("disconnecting slow subscriber %s", sub.Id)
+		sub.disconnectLocked()
+		sub.closeLocked()
+	default:
+		// the writer may take messages in between, so retry until the new
+		// message fits
+		for {
+			select {
+			case <-sub.queue:
+				sub.drop()
+			default:
+			}
+
+			select {
+			case sub.queue <- data:
+				return nil
+			default:
+			}
+		}
+	}
+
+	return nil
+}
+
+func (sub *Subscriber) drop() {
+	sub.dropped.Add(1)
+	sub.manager.dropped.Add(1)
+}
+
+// SendFrame encodes and queues a protocol frame for the subscriber
+func (sub *Subscriber) SendFrame(frame Frame) error {
+	data, err := json.Marshal(frame)
+	if err != nil {
+		return err
+	}
+
+	return sub.Send(data)
+}
+
+// Dropped returns how many messages were discarded because the subscriber
+// could not keep up
+func (sub *Subscriber) Dropped() uint64 {
+	return sub.dropped.Load()
+}
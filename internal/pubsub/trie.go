@@ -0,0 +1,201 @@
+package pubsub
+
+import "strings"
+
+// Topics are split into segments on ':' and '.', each segment keeping the
+// separator in front of it so "insert:billing.orders" becomes "insert",
+// ":billing" and ".orders". In a pattern a "*" segment matches exactly one
+// segment, except as the last segment where it matches the rest of the topic:
+//
+//	*:orders      every event of the orders table
+//	insert:*      every insert, whatever the table
+//	*:billing.*   every event of every table in the billing schema
+//
+// Pattern subscriptions are kept in a trie so a publish only visits the
+// branches that can match its topic.
+type topicNode struct {
+	children map[string]*topicNode // literal or "*" segment to child
+	subs     []*Subscription       // patterns ending at this node
+	rest     map[string][]*Subscription
+}
+
+func newTopicNode() *topicNode {
+	return &topicNode{children: make(map[string]*topicNode)}
+}
+
+// IsPattern reports whether a topic contains wildcard segments
+func IsPattern(topic string) bool {
+	for _, segment := range splitTopic(topic) {
+		if isWildcard(segment) {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchTopic reports whether a topic matches a topic or topic pattern
+func MatchTopic(pattern string, topic string) bool {
+	if !IsPattern(pattern) {
+		return pattern == topic
+	}
+
+	patternSegments := splitTopic(pattern)
+	topicSegments := splitTopic(topic)
+
+	for i, segment := range patternSegments {
+		if i >= len(topicSegments) {
+			return false
+		}
+
+		if isWildcard(segment) {
+			if separator(segment) != separator(topicSegments[i]) {
+				return false
+			}
+			if i == len(patternSegments)-1 {
+				return true
+			}
+		} else if segment != topicSegments[i] {
+			return false
+		}
+	}
+
+	return len(patternSegments) == len(topicSegments)
+}
+
+// coversTopic reports whether every topic matching a topic or pattern also
+// matches the pattern
+func coversTopic(pattern string, topic string) bool {
+	patternSegments := splitTopic(pattern)
+	topicSegments := splitTopic(topic)
+
+	for i, segment := range patternSegments {
+		if i >= len(topicSegments) {
+			return false
+		}
+
+		if isWildcard(segment) {
+			if separator(segment) != separator(topicSegments[i]) {
+				return false
+			}
+			if i == len(patternSegments)-1 {
+				return true
+			}
+			// a wildcard ending the topic also matches longer topics
+			if isWildcard(topicSegments[i]) && i == len(topicSegments)-1 {
+				return false
+			}
+		} else if segment != topicSegments[i] {
+			return false
+		}
+	}
+
+	return len(patternSegments) == len(topicSegments)
+}
+
+func splitTopic(topic string) []string {
+	var segments []string
+
+	start := 0
+	for i := 0; i < len(topic); i++ {
+		if topic[i] == ':' || topic[i] == '.' {
+			segments = append(segments, topic[start:i])
+			start = i
+		}
+	}
+
+	return append(segments, topic[start:])
+}
+
+func isWildcard(segment string) bool {
+	return strings.TrimLeft(segment, ":.") == "*"
+}
+
+// separator returns the separator in front of a segment, empty for the first
+func separator(segment string) string {
+	if segment != "" && (segment[0] == ':' || segment[0] == '.') {
+		return segment[:1]
+	}
+	return ""
+}
+
+func (n *topicNode) insert(pattern string, sub *Subscription) {
+	segments := splitTopic(pattern)
+	node := n
+
+	for i, segment := range segments {
+		if i == len(segments)-1 && isWildcard(segment) {
+			if node.rest == nil {
+				node.rest = make(map[string][]*Subscription)
+			}
+			node.rest[separator(segment)] = append(node.rest[separator(segment)], sub)
+			return
+		}
+
+		child, ok := node.children[segment]
+		if !ok {
+			child = newTopicNode()
+			node.children[segment] = child
+		}
+		node = child
+	}
+
+	node.subs = append(node.subs, sub)
+}
+
+func (n *topicNode) remove(pattern string, sub *Subscription) {
+	n.removeSegments(splitTopic(pattern), sub)
+}
+
+// removeSegments returns true when the node became empty and can be pruned
+func (n *topicNode) removeSegments(segments []string, sub *Subscription) bool {
+	if len(segments) == 1 && isWildcard(segments[0]) {
+		sep := separator(segments[0])
+		n.rest[sep] = removeFrom(n.rest[sep], sub)
+		if len(n.rest[sep]) == 0 {
+			delete(n.rest, sep)
+		}
+	} else if len(segments) == 0 {
+		n.subs = removeFrom(n.subs, sub)
+	} else if child, ok := n.children[segments[0]]; ok {
+		if child.removeSegments(segments[1:], sub) {
+			delete(n.children, segments[0])
+		}
+	}
+
+	return len(n.children) == 0 && len(n.subs) == 0 && len(n.rest) == 0
+}
+
+// match calls fn for every pattern subscription matching the topic
+func (n *topicNode) match(topic string, fn func(*Subscription)) {
+	n.matchSegments(splitTopic(topic), fn)
+}
+
+func (n *topicNode) matchSegments(segments []string, fn func(*Subscription)) {
+	if len(segments) == 0 {
+		for _, sub := range n.subs {
+			fn(sub)
+		}
+		return
+	}
+
+	sep := separator(segments[0])
+	for _, sub := range n.rest[sep] {
+		fn(sub)
+	}
+
+	if child, ok := n.children[segments[0]]; ok {
+		child.matchSegments(segments[1:], fn)
+	}
+	if child, ok := n.children[sep+"*"]; ok {
+		child.matchSegments(segments[1:], fn)
+	}
+}
+
+func removeFrom(subscriptions []*Subscription, sub *Subscription) []*Subscription {
+	for i, c := range subscriptions {
+		if c == sub {
+			return append(subscriptions[:i:i], subscriptions[i+1:]...)
+		}
+	}
+	return subscriptions
+}
@@ -0,0 +1,586 @@
+package transform
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Expressions read the fields of one event and nothing else: there are no
+// assignments, loops or calls outside the functions below, so evaluating one
+// takes time proportional to its length.
+//
+//	literals    'text' "text" 42 1.5 true false null
+//	fields      first_name, products.name (NULL values are null)
+//	operators   || && ! == != < <= > >= + - * / % ( )
+//	functions   concat lower upper trim len substr replace contains
+//	            starts_with ends_with number string round floor ceil abs
+//	            coalesce if
+//
+// Values are strings, numbers, booleans or null. Arithmetic needs numbers,
+// fields holding numbers count as numbers, text is joined with concat.
+// Comparisons are numeric when both sides are numbers.
+
+// node is a parsed expression
+type node interface {
+	eval(message map[string]string) (interface{}, error)
+}
+
+// compile parses an expression
+func compile(source string) (node, error) {
+	tokens, err := lex(source)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parser{tokens: tokens}
+	n, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if p.peek().kind != tokenEOF {
+		return nil, fmt.Errorf("unexpected %s", p.peek())
+	}
+
+	return n, nil
+}
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenNumber
+	tokenString
+	tokenIdent
+	tokenOp
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+func (t token) String() string {
+	if t.kind == tokenEOF {
+		return "end of expression"
+	}
+	return fmt.Sprintf("%q at %d", t.text, t.pos)
+}
+
+var operators = []string{"==", "!=", "<=", ">=", "&&", "||", "<", ">", "!", "+", "-", "*", "/", "%", "(", ")", ","}
+
+func lex(source string) ([]token, error) {
+	var tokens []token
+	for i := 0; i < len(source); {
+		r, size := utf8.DecodeRuneInString(source[i:])
+		switch {
+		case unicode.IsSpace(r):
+			i += size
+
+		case r == '\'' || r == '"':
+			var b strings.Builder
+			j := i + 1
+			for ; j < len(source) && rune(source[j]) != r; j++ {
+				if source[j] == '\\' && j+1 < len(source) {
+					j++
+				}
+				b.WriteByte(source[j])
+			}
+			if j >= len(source) {
+				return nil, fmt.Errorf("unterminated string at %d", i)
+			}
+			tokens = append(tokens, token{kind: tokenString, text: b.String(), pos: i})
+			i = j + 1
+
+		case r >= '0' && r <= '9':
+			j := i
+			for j < len(source) && (source[j] >= '0' && source[j] <= '9' || source[j] == '.') {
+				j++
+			}
+			tokens = append(tokens, token{kind: tokenNumber, text: source[i:j], pos: i})
+			i = j
+
+		case r == '_' || unicode.IsLetter(r):
+			j := i
+			for j < len(source) {
+				r, size := utf8.DecodeRuneInString(source[j:])
+				if r != '_' && r != '.' && !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+					break
+				}
+				j += size
+			}
+			tokens = append(tokens, token{kind: tokenIdent, text: source[i:j], pos: i})
+			i = j
+
+		default:
+			op := ""
+			for _, o := range operators {
+				if strings.HasPrefix(source[i:], o) {
+					op = o
+					break
+				}
+			}
+			if op == "" {
+				return nil, fmt.Errorf("unexpected %q at %d", r, i)
+			}
+			tokens = append(tokens, token{kind: tokenOp, text: op, pos: i})
+			i += len(op)
+		}
+	}
+
+	return append(tokens, token{kind: tokenEOF, pos: len(source)}), nil
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokenEOF {
+		p.pos++
+	}
+	return t
+}
+
+// accept consumes the next token when it is one of the operators
+func (p *parser) accept(ops ...string) (string, bool) {
+	t := p.peek()
+	if t.kind != tokenOp {
+		return "", false
+	}
+	for _, op := range ops {
+		if t.text == op {
+			p.pos++
+			return op, true
+		}
+	}
+	return "", false
+}
+
+func (p *parser) expect(op string) error {
+	if _, ok := p.accept(op); !ok {
+		return fmt.Errorf("expected %q, got %s", op, p.peek())
+	}
+	return nil
+}
+
+func (p *parser) or() (node, error) {
+	return p.binary(p.and, "||")
+}
+
+func (p *parser) and() (node, error) {
+	return p.binary(p.comparison, "&&")
+}
+
+func (p *parser) comparison() (node, error) {
+	left, err := p.sum()
+	if err != nil {
+		return nil, err
+	}
+
+	if op, ok := p.accept("==", "!=", "<=", ">=", "<", ">"); ok {
+		right, err := p.sum()
+		if err != nil {
+			return nil, err
+		}
+		return &binary{op: op, left: left, right: right}, nil
+	}
+
+	return left, nil
+}
+
+func (p *parser) sum() (node, error) {
+	return p.binary(p.product, "+", "-")
+}
+
+func (p *parser) product() (node, error) {
+	return p.binary(p.unary, "*", "/", "%")
+}
+
+// binary parses left associative operators over operands parsed by operand
+func (p *parser) binary(operand func() (node, error), ops ...string) (node, error) {
+	left, err := operand()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		op, ok := p.accept(ops...)
+		if !ok {
+			return left, nil
+		}
+
+		right, err := operand()
+		if err != nil {
+			return nil, err
+		}
+		left = &binary{op: op, left: left, right: right}
+	}
+}
+
+func (p *parser) unary() (node, error) {
+	if op, ok := p.accept("!", "-"); ok {
+		operand, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return &unary{op: op, operand: operand}, nil
+	}
+
+	return p.primary()
+}
+
+func (p *parser) primary() (node, error) {
+	t := p.next()
+	switch t.kind {
+	case tokenNumber:
+		n, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %s", t)
+		}
+		return &literal{value: n}, nil
+
+	case tokenString:
+		return &literal{value: t.text}, nil
+
+	case tokenIdent:
+		switch t.text {
+		case "true":
+			return &literal{value: true}, nil
+		case "false":
+			return &literal{value: false}, nil
+		case "null":
+			return &literal{value: nil}, nil
+		}
+
+		if _, ok := p.accept("("); ok {
+			return p.call(t)
+		}
+		return &field{name: t.text}, nil
+
+	case tokenOp:
+		if t.text == "(" {
+			n, err := p.or()
+			if err != nil {
+				return nil, err
+			}
+			return n, p.expect(")")
+		}
+	}
+
+	return nil, fmt.Errorf("unexpected %s", t)
+}
+
+func (p *parser) call(name token) (node, error) {
+	var args []node
+	if _, ok := p.accept(")"); !ok {
+		for {
+			arg, err := p.or()
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, arg)
+
+			if _, ok := p.accept(","); !ok {
+				break
+			}
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+	}
+
+	if name.text == "if" {
+		if len(args) != 3 {
+			return nil, fmt.Errorf("if takes 3 arguments")
+		}
+		return &conditional{condition: args[0], then: args[1], otherwise: args[2]}, nil
+	}
+
+	fn, ok := functions[name.text]
+	if !ok {
+		return nil, fmt.Errorf("unknown function %s", name)
+	}
+	if len(args) < fn.min || (fn.max >= 0 && len(args) > fn.max) {
+		return nil, fmt.Errorf("wrong number of arguments to %s", name.text)
+	}
+
+	return &call{name: name.text, fn: fn.fn, args: args}, nil
+}
+
+type literal struct {
+	value interface{}
+}
+
+func (n *literal) eval(map[string]string) (interface{}, error) {
+	return n.value, nil
+}
+
+type field struct {
+	name string
+}
+
+func (n *field) eval(message map[string]string) (interface{}, error) {
+	value, ok := message[n.name]
+	if !ok || value == "NULL" {
+		return nil, nil
+	}
+	return value, nil
+}
+
+type unary struct {
+	op      string
+	operand node
+}
+
+func (n *unary) eval(message map[string]string) (interface{}, error) {
+	value, err := n.operand.eval(message)
+	if err != nil {
+		return nil, err
+	}
+
+	if n.op == "!" {
+		b, err := truth(value)
+		return !b, err
+	}
+
+	number, err := toNumber(value)
+	return -number, err
+}
+
+type binary struct {
+	op          string
+	left, right node
+}
+
+func (n *binary) eval(message map[string]string) (interface{}, error) {
+	left, err := n.left.eval(message)
+	if err != nil {
+		return nil, err
+	}
+
+	// && and || only evaluate the right side when they need it
+	if n.op == "&&" || n.op == "||" {
+		b, err := truth(left)
+		if err != nil || b == (n.op == "||") {
+			return b, err
+		}
+		right, err := n.right.eval(message)
+		if err != nil {
+			return nil, err
+		}
+		return truth(right)
+	}
+
+	right, err := n.right.eval(message)
+	if err != nil {
+		return nil, err
+	}
+
+	switch n.op {
+	case "==":
+		return equal(left, right), nil
+	case "!=":
+		return !equal(left, right), nil
+	case "<", "<=", ">", ">=":
+		return compare(n.op, left, right), nil
+	}
+
+	a, err := toNumber(left)
+	if err != nil {
+		return nil, err
+	}
+	b, err := toNumber(right)
+	if err != nil {
+		return nil, err
+	}
+
+	switch n.op {
+	case "+":
+		return a + b, nil
+	case "-":
+		return a - b, nil
+	case "*":
+		return a * b, nil
+	case "/":
+		if b == 0 {
+			return nil, errors.New("division by zero")
+		}
+		return a / b, nil
+	default:
+		if b == 0 {
+			return nil, errors.New("division by zero")
+		}
+		return math.Mod(a, b), nil
+	}
+}
+
+type conditional struct {
+	condition, then, otherwise node
+}
+
+func (n *conditional) eval(message map[string]string) (interface{}, error) {
+	value, err := n.condition.eval(message)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := truth(value)
+	if err != nil {
+		return nil, err
+	}
+	if b {
+		return n.then.eval(message)
+	}
+	return n.otherwise.eval(message)
+}
+
+type call struct {
+	name string
+	fn   func(args []interface{}) (interface{}, error)
+	args []node
+}
+
+func (n *call) eval(message map[string]string) (interface{}, error) {
+	args := make([]interface{}, len(n.args))
+	for i, arg := range n.args {
+		value, err := arg.eval(message)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = value
+	}
+
+	value, err := n.fn(args)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", n.name, err)
+	}
+	return value, nil
+}
+
+// truth returns the value of a condition, null is false and fields holding
+// booleans count as booleans
+func truth(value interface{}) (bool, error) {
+	switch v := value.(type) {
+	case nil:
+		return false, nil
+	case bool:
+		return v, nil
+	case string:
+		if b, err := strconv.ParseBool(v); err == nil {
+			return b, nil
+		}
+	}
+
+	return false, fmt.Errorf("%s is not a boolean", format(value))
+}
+
+// toNumber returns the value of a number, fields holding numbers count as
+// numbers
+func toNumber(value interface{}) (float64, error) {
+	switch v := value.(type) {
+	case float64:
+		return v, nil
+	case string:
+		if n, err := strconv.ParseFloat(strings.TrimSpace(v), 64); err == nil {
+			return n, nil
+		}
+	}
+
+	return 0, fmt.Errorf("%s is not a number", quote(value))
+}
+
+func equal(left interface{}, right interface{}) bool {
+	if left == nil || right == nil {
+		return left == nil && right == nil
+	}
+
+	if a, err := toNumber(left); err == nil {
+		if b, err := toNumber(right); err == nil {
+			return a == b
+		}
+	}
+
+	_, leftBool := left.(bool)
+	_, rightBool := right.(bool)
+	if leftBool || rightBool {
+		a, err := truth(left)
+		b, err2 := truth(right)
+		return err == nil && err2 == nil && a == b
+	}
+
+	return format(left) == format(right)
+}
+
+// compare orders numbers by value and anything else as text, null is never
+// ordered
+func compare(op string, left interface{}, right interface{}) bool {
+	if left == nil || right == nil {
+		return false
+	}
+
+	var c int
+	a, err := toNumber(left)
+	b, err2 := toNumber(right)
+	if err == nil && err2 == nil {
+		c = cmpFloat(a, b)
+	} else {
+		c = strings.Compare(format(left), format(right))
+	}
+
+	switch op {
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	default:
+		return c >= 0
+	}
+}
+
+func cmpFloat(a float64, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// format returns the field value of an expression result, NULL for null
+func format(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "NULL"
+	case bool:
+		return strconv.FormatBool(v)
+	case float64:
+		if v == math.Trunc(v) && math.Abs(v) < 1e15 {
+			return strconv.FormatInt(int64(v), 10)
+		}
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+func quote(value interface{}) string {
+	if s, ok := value.(string); ok {
+		return strconv.Quote(s)
+	}
+	return format(value)
+}
@@ -0,0 +1,149 @@
+package transform
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+type function struct {
+	min, max int // number of arguments, max -1 for any
+	fn       func(args []interface{}) (interface{}, error)
+}
+
+var functions = map[string]function{
+	"concat": {1, -1, func(args []interface{}) (interface{}, error) {
+		var b strings.Builder
+		for _, arg := range args {
+			if arg != nil {
+				b.WriteString(format(arg))
+			}
+		}
+		return b.String(), nil
+	}},
+	"lower": text(strings.ToLower),
+	"upper": text(strings.ToUpper),
+	"trim":  text(strings.TrimSpace),
+	"len": {1, 1, func(args []interface{}) (interface{}, error) {
+		if args[0] == nil {
+			return nil, nil
+		}
+		return float64(len([]rune(format(args[0])))), nil
+	}},
+	"substr": {2, 3, func(args []interface{}) (interface{}, error) {
+		if args[0] == nil {
+			return nil, nil
+		}
+		runes := []rune(format(args[0]))
+		start, err := toIndex(args[1])
+		if err != nil {
+			return nil, err
+		}
+		end := float64(len(runes))
+		if len(args) == 3 {
+			length, err := toIndex(args[2])
+			if err != nil {
+				return nil, err
+			}
+			end = start + length
+		}
+		from := int(math.Max(0, math.Min(start, float64(len(runes)))))
+		to := int(math.Max(float64(from), math.Min(end, float64(len(runes)))))
+		return string(runes[from:to]), nil
+	}},
+	"replace": {3, 3, func(args []interface{}) (interface{}, error) {
+		if args[0] == nil {
+			return nil, nil
+		}
+		return strings.ReplaceAll(format(args[0]), format(args[1]), format(args[2])), nil
+	}},
+	"contains":    test(strings.Contains),
+	"starts_with": test(strings.HasPrefix),
+	"ends_with":   test(strings.HasSuffix),
+	"number": {1, 1, func(args []interface{}) (interface{}, error) {
+		if args[0] == nil {
+			return nil, nil
+		}
+		return toNumber(args[0])
+	}},
+	"string": {1, 1, func(args []interface{}) (interface{}, error) {
+		if args[0] == nil {
+			return nil, nil
+		}
+		return format(args[0]), nil
+	}},
+	"round": {1, 2, func(args []interface{}) (interface{}, error) {
+		if args[0] == nil {
+			return nil, nil
+		}
+		n, err := toNumber(args[0])
+		if err != nil {
+			return nil, err
+		}
+		digits := 0.0
+		if len(args) == 2 {
+			if digits, err = toNumber(args[1]); err != nil {
+				return nil, err
+			}
+		}
+		scale := math.Pow(10, math.Trunc(digits))
+		return math.Round(n*scale) / scale, nil
+	}},
+	"floor": numeric(math.Floor),
+	"ceil":  numeric(math.Ceil),
+	"abs":   numeric(math.Abs),
+	"coalesce": {1, -1, func(args []interface{}) (interface{}, error) {
+		for _, arg := range args {
+			if arg != nil {
+				return arg, nil
+			}
+		}
+		return nil, nil
+	}},
+}
+
+// toIndex converts a position or length, NaN and infinities are no index
+func toIndex(value interface{}) (float64, error) {
+	n, err := toNumber(value)
+	if err != nil {
+		return 0, err
+	}
+	if math.IsNaN(n) || math.IsInf(n, 0) {
+		return 0, fmt.Errorf("%s is not an index", quote(value))
+	}
+	return n, nil
+}
+
+// text makes a function of one string, null stays null
+func text(fn func(string) string) function {
+	return function{1, 1, func(args []interface{}) (interface{}, error) {
+		if args[0] == nil {
+			return nil, nil
+		}
+		return fn(format(args[0])), nil
+	}}
+}
+
+// test makes a function testing a string against another one
+func test(fn func(string, string) bool) function {
+	return function{2, 2, func(args []interface{}) (interface{}, error) {
+		if args[0] == nil || args[1] == nil {
+			return false, nil
+		}
+		return fn(format(args[0]), format(args[1])), nil
+	}}
+}
+
+// numeric makes a function of one number, null stays null
+func numeric(fn func(float64) float64) function {
+	return function{1, 1, func(args []interface{}) (interface{}, error) {
+		if args[0] == nil {
+			return nil, nil
+		}
+		n, err := toNumber(args[0])
+		if err != nil {
+			return nil, err
+		}
+		return fn(n), nil
+	}}
+}
@@ -0,0 +1,220 @@
+package transform
+
+import (
+	"fmt"
+	"log"
+	"maps"
+	"realtimer/internal/config"
+	"slices"
+	"strings"
+)
+
+// Transformer runs the transform steps of the tables that declare them on
+// their events before they are published
+type Transformer struct {
+	steps map[string][]step // by table
+}
+
+// step is a parsed config.Transform
+type step struct {
+	rename []renaming // in order of the renamed field
+	set    []assignment
+	remove []string
+	dropIf node
+}
+
+type renaming struct {
+	from, to string
+}
+
+type assignment struct {
+	field string
+	expr  node
+}
+
+// New returns a transformer for the transform steps of the configured
+// tables, nil when no table has any
+func New(cfg config.DBConfig) (*Transformer, error) {
+	steps := make(map[string][]step)
+	for _, table := range cfg.Tables {
+		key := table.PrimaryKey
+		if len(key) == 0 {
+			key = []string{"id"}
+		}
+
+		for i, transform := range table.Transform {
+			s, err := newStep(transform, key)
+			if err != nil {
+				return nil, fmt.Errorf("invalid transform %d of table %s: %w", i+1, table.Name, err)
+			}
+			steps[table.Name] = append(steps[table.Name], s)
+		}
+	}
+
+	if len(steps) == 0 {
+		return nil, nil
+	}
+
+	return &Transformer{steps: steps}, nil
+}
+
+// newStep parses a step, the primary key columns cannot be renamed or
+// removed, rows are told apart by them after the transforms
+func newStep(transform config.Transform, key []string) (step, error) {
+	s := step{remove: transform.Remove}
+
+	// renames are checked and applied in a fixed order
+	froms := make([]string, 0, len(transform.Rename))
+	for from := range transform.Rename {
+		froms = append(froms, from)
+	}
+	slices.Sort(froms)
+
+	targets := make(map[string]string)
+	for _, from := range froms {
+		to := transform.Rename[from]
+		for _, field := range []string{from, to} {
+			if slices.Contains(key, field) {
+				return step{}, fmt.Errorf("rename %s: %s is a primary key column", from, field)
+			}
+		}
+		if _, ok := transform.Rename[to]; ok {
+			return step{}, fmt.Errorf("rename %s: %s is renamed too, use another step", from, to)
+		}
+		if other, ok := targets[to]; ok {
+			return step{}, fmt.Errorf("rename %s: %s is renamed to %s too", from, other, to)
+		}
+		targets[to] = from
+		s.rename = append(s.rename, renaming{from: from, to: to})
+	}
+
+	for _, field := range transform.Remove {
+		if slices.Contains(key, field) {
+			return step{}, fmt.Errorf("remove: %s is a primary key column", field)
+		}
+	}
+
+	// fields are set in a fixed order, they all see the event as it was
+	// before the step
+	fields := make([]string, 0, len(transform.Set))
+	for field := range transform.Set {
+		fields = append(fields, field)
+	}
+	slices.Sort(fields)
+
+	for _, field := range fields {
+		expr, err := compile(transform.Set[field])
+		if err != nil {
+			return step{}, fmt.Errorf("%s: %w", field, err)
+		}
+		s.set = append(s.set, assignment{field: field, expr: expr})
+	}
+
+	if transform.DropIf != "" {
+		expr, err := compile(transform.DropIf)
+		if err != nil {
+			return step{}, fmt.Errorf("drop_if: %w", err)
+		}
+		s.dropIf = expr
+	}
+
+	return s, nil
+}
+
+// Transform is the pubsub stage running the steps of the event's table. An
+// expression failing on an event is logged and removes its field, or keeps
+// the event for drop_if, a rename onto a field the event has is logged and
+// skipped, the other steps still run.
+func (t *Transformer) Transform(topic string, message map[string]string) map[string]string {
+	_, table, _ := strings.Cut(topic, ":")
+	steps, ok := t.steps[table]
+	if !ok {
+		return message
+	}
+
+	// the message may be shared with the caller
+	transformed := maps.Clone(message)
+	for i, s := range steps {
+		var drop bool
+		transformed, drop = s.safeRun(transformed, func(err error) {
+			log.Printf("error in transform %d of %s event of id %q: %v", i+1, topic, message["id"], err)
+		})
+		if drop {
+			return nil
+		}
+	}
+
+	return transformed
+}
+
+// safeRun runs a step, reporting a panic as an error of the event instead of
+// taking the process down, the event keeps what the step did until then
+func (s step) safeRun(message map[string]string, report func(err error)) (transformed map[string]string, drop bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			report(fmt.Errorf("panic: %v", r))
+			transformed, drop = message, false
+		}
+	}()
+
+	return s.run(message, report)
+}
+
+// run applies a step to a message it owns, drop is true when the event has
+// to be dropped
+func (s step) run(message map[string]string, report func(err error)) (map[string]string, bool) {
+	for _, r := range s.rename {
+		value, ok := message[r.from]
+		if !ok {
+			continue
+		}
+		if _, ok := message[r.to]; ok {
+			report(fmt.Errorf("rename %s: %s already exists", r.from, r.to))
+			continue
+		}
+
+		delete(message, r.from)
+		message[r.to] = value
+	}
+
+	if len(s.set) > 0 {
+		values := make(map[string]string, len(s.set))
+		var failed []string
+		for _, a := range s.set {
+			value, err := a.expr.eval(message)
+			if err != nil {
+				report(fmt.Errorf("%s: %w", a.field, err))
+				failed = append(failed, a.field)
+				continue
+			}
+			values[a.field] = format(value)
+		}
+		maps.Copy(message, values)
+
+		// the field does not keep a value the expression was meant to replace
+		for _, field := range failed {
+			delete(message, field)
+		}
+	}
+
+	for _, field := range s.remove {
+		delete(message, field)
+	}
+
+	if s.dropIf != nil {
+		value, err := s.dropIf.eval(message)
+		if err != nil {
+			report(fmt.Errorf("drop_if: %w", err))
+			return message, false
+		}
+
+		drop, err := truth(value)
+		if err != nil {
+			report(fmt.Errorf("drop_if: %w", err))
+			return message, false
+		}
+		return message, drop
+	}
+
+	return message, false
+}
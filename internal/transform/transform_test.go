@@ -0,0 +1,34 @@
+package transform
+
+import (
+	"realtimer/internal/config"
+	"reflect"
+	"testing"
+)
+
+func TestSubstrNotANumber(t *testing.T) {
+	var cfg config.DBConfig
+	cfg.Tables = config.Tables{{
+		Name: "orders",
+		Transform: []config.Transform{{Set: map[string]string{
+			"head": "substr(name, amount)",
+			"tail": "substr(name, 1, amount)",
+		}}},
+	}}
+
+	transformer, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, amount := range []string{"NaN", "Inf", "-Inf"} {
+		message := map[string]string{"id": "1", "name": "widget", "amount": amount, "head": "old"}
+		got := transformer.Transform("insert:orders", message)
+
+		// the failing expressions remove their field
+		want := map[string]string{"id": "1", "name": "widget", "amount": amount}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("amount %s: Transform = %v, want %v", amount, got, want)
+		}
+	}
+}
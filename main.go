@@ -3,9 +3,15 @@ package main
 import (
 	"fmt"
 	"realtimer/internal/adapters"
+	"realtimer/internal/aggregate"
 	"realtimer/internal/api"
 	"realtimer/internal/config"
+	"realtimer/internal/enrich"
+	"realtimer/internal/eventlog"
+	"realtimer/internal/livequery"
+	"realtimer/internal/plugin"
 	"realtimer/internal/pubsub"
+	"realtimer/internal/transform"
 )
 
 func main() {
@@ -14,14 +20,46 @@ func main() {
 		panic(err)
 	}
 
-	var pubsubManager *pubsub.SubscriptionManager = pubsub.NewSubscriptionManager()
+	eventLog, err := eventlog.Open(cfg)
+	if err != nil {
+		panic(err)
+	}
+
+	pubsubManager, err := pubsub.NewSubscriptionManager(cfg, eventLog)
+	if err != nil {
+		panic(err)
+	}
+
+	if enricher := enrich.New(cfg); enricher != nil {
+		pubsubManager.Use(enricher.Enrich)
+	}
 
-	err = adapters.New(cfg)
+	transformer, err := transform.New(cfg)
 	if err != nil {
 		panic(err)
 	}
+	if transformer != nil {
+		pubsubManager.Use(transformer.Transform)
+	}
+
+	err = plugin.Load(cfg, pubsubManager)
+	if err != nil {
+		panic(err)
+	}
+
+	err = adapters.New(cfg, pubsubManager)
+	if err != nil {
+		panic(err)
+	}
+
+	err = aggregate.Start(cfg, pubsubManager)
+	if err != nil {
+		panic(err)
+	}
+
+	liveQueries := livequery.New(cfg, pubsubManager)
 
-	server := api.New(cfg, pubsubManager)
+	server := api.New(cfg, pubsubManager, liveQueries)
 	server.RegisterFiberRoutes()
 
 	err = server.Listen(fmt.Sprintf(":%d", cfg.Servers.HTTPPort))
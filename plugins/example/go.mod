@@ -0,0 +1,3 @@
+module realtimer/plugins/example
+
+go 1.24
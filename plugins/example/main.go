@@ -0,0 +1,66 @@
+// Example realtimer plugin: drops test rows and adds a large:<table> event
+// for inserts with an amount above 1000.
+//
+//	GOOS=wasip1 GOARCH=wasm go build -buildmode=c-shared -o example.wasm
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"unsafe"
+)
+
+type event struct {
+	Topic string            `json:"topic"`
+	Data  map[string]string `json:"data"`
+}
+
+// input and output are kept here, the host reads and writes them between
+// calls
+var input, output []byte
+
+//go:wasmimport realtimer log
+func hostLog(ptr unsafe.Pointer, size uint32)
+
+func logf(message string) {
+	hostLog(unsafe.Pointer(unsafe.StringData(message)), uint32(len(message)))
+}
+
+//go:wasmexport alloc
+func alloc(size uint32) uint32 {
+	input = make([]byte, size)
+	return uint32(uintptr(unsafe.Pointer(unsafe.SliceData(input))))
+}
+
+//go:wasmexport process
+func process(ptr uint32, size uint32) uint64 {
+	var in event
+	if err := json.Unmarshal(input[:size], &in); err != nil {
+		// 0 would drop the event, output that is not an array of events
+		// makes the host handle it as a failure
+		logf("invalid event: " + err.Error())
+		output = []byte("invalid event")
+		return result()
+	}
+
+	if in.Data["test"] == "true" {
+		return 0
+	}
+
+	events := []event{in}
+	operation, table, _ := strings.Cut(in.Topic, ":")
+	if amount, err := strconv.ParseFloat(in.Data["amount"], 64); operation == "insert" && err == nil && amount > 1000 {
+		events = append(events, event{Topic: "large:" + table, Data: map[string]string{"id": in.Data["id"], "amount": in.Data["amount"]}})
+	}
+
+	output, _ = json.Marshal(events)
+	return result()
+}
+
+// result returns output as ptr<<32 | len
+func result() uint64 {
+	return uint64(uintptr(unsafe.Pointer(unsafe.SliceData(output))))<<32 | uint64(len(output))
+}
+
+func main() {}